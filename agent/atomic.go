@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"blackbox/pkg"
+)
+
+// atomicFile writes to a temp file next to path and renames it over path on commit, so
+// readers never see a partial file and a crash or disconnect leaves the old content in place.
+type atomicFile struct {
+	f    *os.File
+	path string
+	sum  hash.Hash
+	// noReplace makes commit fail with pkg.StreamErrExists instead of replacing a file.
+	noReplace bool
+}
+
+func createAtomic(path string) (*atomicFile, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".blackbox-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	// CreateTemp uses 0600; keep the mode of the file being replaced, else the usual 0644.
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &atomicFile{f: f, path: path, sum: sha256.New()}, nil
+}
+
+func (a *atomicFile) Write(p []byte) (int, error) {
+	n, err := a.f.Write(p)
+	a.sum.Write(p[:n])
+	return n, err
+}
+
+// commit checks the SHA-256 of what was written against wantSHA256 (hex, optional),
+// flushes it to disk and renames it over the destination.
+func (a *atomicFile) commit(wantSHA256 string) error {
+	if wantSHA256 != "" {
+		if got := hex.EncodeToString(a.sum.Sum(nil)); !strings.EqualFold(got, wantSHA256) {
+			a.abort()
+			return fmt.Errorf("checksum mismatch: got sha256 %s", got)
+		}
+	}
+	if err := a.f.Sync(); err != nil {
+		a.abort()
+		return err
+	}
+	if err := a.f.Close(); err != nil {
+		os.Remove(a.f.Name())
+		return err
+	}
+	if a.noReplace {
+		err := linkNoReplace(a.f.Name(), a.path)
+		os.Remove(a.f.Name())
+		if err != nil {
+			return err
+		}
+	} else if err := os.Rename(a.f.Name(), a.path); err != nil {
+		os.Remove(a.f.Name())
+		return err
+	}
+	syncDir(filepath.Dir(a.path))
+	return nil
+}
+
+// linkNoReplace gives the file at tmp the name path unless path exists. A hard link fails
+// atomically if it does; on filesystems without hard links it falls back to a check and
+// rename, which leaves a small window. tmp is left for the caller to remove.
+func linkNoReplace(tmp, path string) error {
+	err := os.Link(tmp, path)
+	if err == nil {
+		return nil
+	}
+	if os.IsExist(err) {
+		return errors.New(pkg.StreamErrExists)
+	}
+	if _, err := os.Lstat(path); err == nil {
+		return errors.New(pkg.StreamErrExists)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// abort discards the temp file; the destination is untouched.
+func (a *atomicFile) abort() {
+	a.f.Close()
+	os.Remove(a.f.Name())
+}
+
+// syncDir flushes a directory entry change (rename) to disk. Best effort: not all
+// platforms allow opening directories for sync.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// fileSHA256 returns the hex SHA-256 of the file at path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := f.WriteTo(h); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
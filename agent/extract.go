@@ -0,0 +1,214 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"blackbox/pkg"
+)
+
+// maxExtractFailures bounds the per-entry error report of one extraction.
+const maxExtractFailures = 1000
+
+// extractor writes archive entries below dest, recording per-entry failures in resp.
+type extractor struct {
+	ctx       context.Context
+	dest      string
+	overwrite bool
+	resp      *pkg.ExtractResponse
+}
+
+func handleExtract(ctx context.Context, root string, req *pkg.ExtractRequest) pkg.ExtractResponse {
+	resp := pkg.ExtractResponse{Type: pkg.TypeExtract, RequestID: req.RequestID}
+	src, dest := safePath(root, req.Path), safePath(root, req.Dest)
+	if src == "" || dest == "" {
+		resp.Error = "invalid path"
+		return resp
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	if info.IsDir() {
+		resp.Error = "is a directory"
+		return resp
+	}
+	format, err := archiveFormat(f, src)
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	x := &extractor{ctx: ctx, dest: dest, overwrite: req.Overwrite, resp: &resp}
+	switch format {
+	case "zip":
+		err = x.zip(f, info.Size())
+	case "tar":
+		err = x.tar(f)
+	case "tar.gz":
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(f); err == nil {
+			err = x.tar(gz)
+		}
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+// archiveFormat detects zip, tar.gz or tar from the file's first bytes, falling back to the name.
+func archiveFormat(f *os.File, name string) (string, error) {
+	head := make([]byte, 512)
+	n, _ := f.ReadAt(head, 0)
+	head = head[:n]
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return "zip", nil
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return "tar.gz", nil
+	case len(head) >= 262 && string(head[257:262]) == "ustar", strings.HasSuffix(strings.ToLower(name), ".tar"):
+		return "tar", nil
+	}
+	return "", fmt.Errorf("unsupported archive format (zip, tar and tar.gz are supported)")
+}
+
+func (x *extractor) zip(f *os.File, size int64) error {
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		if err := x.ctx.Err(); err != nil {
+			return err
+		}
+		mode := zf.Mode()
+		switch {
+		case mode.IsDir():
+			x.dir(zf.Name)
+		case mode&os.ModeSymlink != 0:
+			x.fail(zf.Name, "links are not extracted")
+		case mode.IsRegular():
+			rc, err := zf.Open()
+			if err != nil {
+				x.fail(zf.Name, err.Error())
+				continue
+			}
+			x.file(zf.Name, mode.Perm(), rc)
+			rc.Close()
+		default:
+			x.fail(zf.Name, "unsupported entry type")
+		}
+	}
+	return nil
+}
+
+func (x *extractor) tar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		if err := x.ctx.Err(); err != nil {
+			return err
+		}
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch h.Typeflag {
+		case tar.TypeDir:
+			x.dir(h.Name)
+		case tar.TypeReg:
+			x.file(h.Name, os.FileMode(h.Mode).Perm(), tr)
+		case tar.TypeSymlink, tar.TypeLink:
+			x.fail(h.Name, "links are not extracted")
+		default:
+			x.fail(h.Name, "unsupported entry type")
+		}
+	}
+}
+
+// target returns where entry name goes, or "" if it would escape dest (zip slip).
+func (x *extractor) target(name string) string {
+	if name == "" || strings.HasPrefix(name, "/") || strings.HasPrefix(name, `\`) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return ""
+	}
+	return safePath(x.dest, filepath.FromSlash(name))
+}
+
+func (x *extractor) dir(name string) {
+	t := x.target(name)
+	if t == "" {
+		x.fail(name, "unsafe path")
+		return
+	}
+	if err := os.MkdirAll(t, 0755); err != nil {
+		x.fail(name, err.Error())
+	}
+}
+
+func (x *extractor) file(name string, perm os.FileMode, r io.Reader) {
+	t := x.target(name)
+	if t == "" || t == x.dest {
+		x.fail(name, "unsafe path")
+		return
+	}
+	if !x.overwrite {
+		if _, err := os.Lstat(t); err == nil {
+			x.fail(name, "exists")
+			return
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(t), 0755); err != nil {
+		x.fail(name, err.Error())
+		return
+	}
+	a, err := createAtomic(t)
+	if err != nil {
+		x.fail(name, err.Error())
+		return
+	}
+	// Keep the archived permissions, but never lock the agent out of its own files.
+	if err := a.f.Chmod(perm | 0600); err != nil {
+		a.abort()
+		x.fail(name, err.Error())
+		return
+	}
+	n, err := io.Copy(a, ctxReader{x.ctx, r})
+	if err == nil {
+		err = a.commit("")
+	} else {
+		a.abort()
+	}
+	if err != nil {
+		x.fail(name, err.Error())
+		return
+	}
+	x.resp.Files++
+	x.resp.Bytes += n
+}
+
+func (x *extractor) fail(name, msg string) {
+	if len(x.resp.Failed) < maxExtractFailures {
+		x.resp.Failed = append(x.resp.Failed, pkg.ExtractFailure{Name: name, Error: msg})
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"blackbox/pkg"
+)
+
+func handleRename(ctx context.Context, root string, req *pkg.RenameRequest) pkg.RenameResponse {
+	resp := pkg.RenameResponse{Type: pkg.TypeRename, RequestID: req.RequestID}
+	from, to, _, err := prepareMove(root, req.From, req.To, req.Overwrite)
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	if from == to {
+		return resp
+	}
+	// A case-only rename on a case-insensitive filesystem finds "to" already there; the
+	// rename still changes the case.
+	err = os.Rename(from, to)
+	if errors.Is(err, syscall.EXDEV) {
+		// Another filesystem is mounted inside the hosted root: copy, then remove the source.
+		if err = copyTree(ctx, from, to); err == nil {
+			err = os.RemoveAll(from)
+		}
+	}
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	syncDir(filepath.Dir(to))
+	return resp
+}
+
+func handleCopy(ctx context.Context, root string, req *pkg.CopyRequest) pkg.CopyResponse {
+	resp := pkg.CopyResponse{Type: pkg.TypeCopy, RequestID: req.RequestID}
+	from, to, same, err := prepareMove(root, req.From, req.To, req.Overwrite)
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	if same {
+		resp.Error = "source and destination are the same"
+		return resp
+	}
+	if err := copyTree(ctx, from, to); err != nil {
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+func handleMkdir(root string, req *pkg.MkdirRequest) pkg.MkdirResponse {
+	resp := pkg.MkdirResponse{Type: pkg.TypeMkdir, RequestID: req.RequestID}
+	path := safePath(root, req.Path)
+	if path == "" {
+		resp.Error = "invalid path"
+		return resp
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	if err := os.Mkdir(path, 0755); os.IsExist(err) {
+		resp.Error = "already exists"
+	} else if err != nil {
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+// prepareMove resolves and checks the source and destination of a rename or copy, and makes
+// room for the destination: parent directories are created, and with overwrite an existing
+// directory at (or for) the destination is removed. A file replacing a file is left to the
+// rename, which replaces it atomically. same reports that to already names the file at from:
+// the same path, a hard link, or another case of the name on a case-insensitive filesystem.
+// Nothing is removed then, and from == to only for the same path.
+func prepareMove(root, fromRel, toRel string, overwrite bool) (from, to string, same bool, err error) {
+	from, to = safePath(root, fromRel), safePath(root, toRel)
+	if from == "" || to == "" {
+		return "", "", false, fmt.Errorf("invalid path")
+	}
+	if from == filepath.Clean(root) || to == filepath.Clean(root) {
+		return "", "", false, fmt.Errorf("cannot move or replace the hosted root")
+	}
+	if strings.HasPrefix(to, from+string(filepath.Separator)) {
+		return "", "", false, fmt.Errorf("cannot move or copy a directory into itself")
+	}
+	src, err := os.Lstat(from)
+	if err != nil {
+		return "", "", false, err
+	}
+	if dst, err := os.Lstat(to); err == nil {
+		if os.SameFile(src, dst) {
+			return from, to, true, nil
+		}
+		if !overwrite {
+			return "", "", false, fmt.Errorf("destination exists")
+		}
+		if src.IsDir() || dst.IsDir() {
+			if err := os.RemoveAll(to); err != nil {
+				return "", "", false, err
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return "", "", false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return "", "", false, err
+	}
+	return from, to, false, nil
+}
+
+// copyTree copies the file, symlink or directory tree at src to dst, stopping when ctx is
+// done. Files are written atomically; a failed directory copy removes what it created.
+func copyTree(ctx context.Context, src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return copyEntry(ctx, src, dst, info)
+	}
+	// Only a directory this call created is cleaned up: if dst appeared since prepareMove
+	// looked, it belongs to someone else.
+	if err := os.Mkdir(dst, info.Mode().Perm()|0700); err != nil {
+		return err
+	}
+	if err := copyDirEntries(ctx, src, dst); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	return nil
+}
+
+func copyDir(ctx context.Context, src, dst string, info os.FileInfo) error {
+	if err := os.Mkdir(dst, info.Mode().Perm()|0700); err != nil {
+		return err
+	}
+	return copyDirEntries(ctx, src, dst)
+}
+
+// copyDirEntries copies the entries of directory src into the existing directory dst.
+func copyDirEntries(ctx context.Context, src, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s, d := filepath.Join(src, e.Name()), filepath.Join(dst, e.Name())
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			err = copyDir(ctx, s, d, info)
+		} else {
+			err = copyEntry(ctx, s, d, info)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyEntry copies one non-directory entry. Symlinks are recreated with the same target.
+func copyEntry(ctx context.Context, src, dst string, info os.FileInfo) error {
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dst)
+	case info.Mode().IsRegular():
+		return copyFile(ctx, src, dst, info.Mode().Perm())
+	}
+	return fmt.Errorf("%s: cannot copy special file", info.Name())
+}
+
+func copyFile(ctx context.Context, src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	a, err := createAtomic(dst)
+	if err != nil {
+		return err
+	}
+	if err := a.f.Chmod(mode); err != nil {
+		a.abort()
+		return err
+	}
+	if _, err := io.Copy(a, ctxReader{ctx, in}); err != nil {
+		a.abort()
+		return err
+	}
+	return a.commit("")
+}
+
+// ctxReader stops a copy between reads once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
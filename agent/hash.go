@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"blackbox/pkg"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/zeebo/blake3"
+)
+
+// Partial results (hash_entries, search_matches) are sent in batches of partialBatch, or
+// sooner once partialFlush has passed, so bastion sees progress on slow walks.
+const (
+	partialBatch = 256
+	partialFlush = time.Second
+)
+
+func newHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case pkg.HashSHA256:
+		return sha256.New(), nil
+	case pkg.HashBLAKE3:
+		return blake3.New(), nil
+	case pkg.HashXXHash:
+		return xxhash.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported algorithm %q", algorithm)
+}
+
+func (s *session) handleHash(ctx context.Context, req *pkg.HashRequest) pkg.HashResponse {
+	alg := req.Algorithm
+	if alg == "" {
+		alg = pkg.HashSHA256
+	}
+	resp := pkg.HashResponse{Type: pkg.TypeHash, RequestID: req.RequestID, Algorithm: alg}
+	if _, err := newHash(alg); err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	root := safePath(s.root, req.Path)
+	if root == "" {
+		resp.Error = "invalid path"
+		return resp
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	if !info.IsDir() {
+		sum, n, err := hashFile(ctx, alg, root)
+		if err != nil {
+			resp.Error = err.Error()
+			return resp
+		}
+		resp.Digest, resp.Files, resp.Bytes = sum, 1, n
+		return resp
+	}
+	if err := s.hashTree(ctx, root, &resp); err != nil {
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+// hashTree hashes every regular file below root, sending the entries as it goes. Symlinks and
+// special files are skipped; unreadable files are reported as failed entries.
+func (s *session) hashTree(ctx context.Context, root string, resp *pkg.HashResponse) error {
+	var hashed []pkg.HashEntry
+	var batch []pkg.HashEntry
+	last := time.Now()
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := s.send(pkg.HashEntries{Type: pkg.TypeHashEntries, RequestID: resp.RequestID, Entries: batch})
+		batch, last = nil, time.Now()
+		return err
+	}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil && path == root {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		entry := pkg.HashEntry{Path: filepath.ToSlash(rel)}
+		switch {
+		case err != nil:
+			// Unreadable subdirectory: WalkDir skips it after this call.
+			entry.Error = err.Error()
+			resp.Failed++
+		case !d.Type().IsRegular():
+			return nil
+		default:
+			sum, n, err := hashFile(ctx, resp.Algorithm, path)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				entry.Error = err.Error()
+				resp.Failed++
+			} else {
+				entry.Digest, entry.Size = sum, n
+				hashed = append(hashed, entry)
+				resp.Files++
+				resp.Bytes += n
+			}
+		}
+		batch = append(batch, entry)
+		if len(batch) >= partialBatch || time.Since(last) >= partialFlush {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return err
+	}
+	if resp.Failed > 0 {
+		return nil
+	}
+	// WalkDir sorts per directory ("a/x" before "a.txt"); the manifest is sorted by whole path.
+	sort.Slice(hashed, func(i, j int) bool { return hashed[i].Path < hashed[j].Path })
+	manifest, _ := newHash(resp.Algorithm)
+	for _, e := range hashed {
+		fmt.Fprintf(manifest, "%s  %s\n", e.Digest, e.Path)
+	}
+	resp.Digest = hex.EncodeToString(manifest.Sum(nil))
+	return nil
+}
+
+func hashFile(ctx context.Context, algorithm, path string) (string, int64, error) {
+	h, err := newHash(algorithm)
+	if err != nil {
+		return "", 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	n, err := io.Copy(h, ctxReader{ctx, f})
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"time"
+
+	"blackbox/pkg"
+
+	"github.com/gorilla/websocket"
+)
+
+// startKeepalive arms the read deadline and pings bastion every pkg.PingInterval until the
+// session ends. If nothing arrives for pkg.PongWait (the network dropped without a close,
+// e.g. after sleep), the read loop fails and the agent reconnects.
+func (s *session) startKeepalive() {
+	s.touch()
+	s.conn.SetPongHandler(func(string) error {
+		s.touch()
+		return nil
+	})
+	s.conn.SetPingHandler(func(data string) error {
+		s.touch()
+		// A failed pong shows up as a read error or timeout soon enough.
+		_ = s.conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(pkg.PingTimeout))
+		return nil
+	})
+	go func() {
+		t := time.NewTicker(pkg.PingInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-t.C:
+			}
+			_ = s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pkg.PingTimeout))
+		}
+	}()
+}
+
+// touch extends the read deadline. Called only from the reading goroutine.
+func (s *session) touch() {
+	_ = s.conn.SetReadDeadline(time.Now().Add(pkg.PongWait))
+}
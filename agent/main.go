@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -20,13 +21,24 @@ import (
 
 const defaultBastionURL = "ws://localhost:8080/ws/agent"
 
+// version is the agent build version, set with -ldflags "-X main.version=...".
+var version = "dev"
+
+// capabilities are advertised to bastion in the auth handshake.
+var capabilities = []string{pkg.CapStream, pkg.CapErrors, pkg.CapCancel, pkg.CapUpload, pkg.CapSHA256, pkg.CapFileOps, pkg.CapExtract, pkg.CapHash, pkg.CapSearch, pkg.CapNoReplace}
+
 var errAuthFailed = fmt.Errorf("auth failed")
 
 func main() {
 	bastionURL := flag.String("bastion-url", "", "blackbox-server WebSocket URL")
 	token := flag.String("token", "", "blackbox agent token (from blackbox-console)")
 	hostedPath := flag.String("hosted-path", "", "Root directory to expose (e.g. /path/to/dir or C:\\Users\\you\\files)")
+	concurrency := flag.Int("concurrency", 8, "Max requests handled at once (list, meta, delete, ...); transfers are not counted")
+	watch := flag.Bool("watch", true, "Report file changes under the hosted path to bastion as they happen")
 	flag.Parse()
+	if *concurrency < 1 {
+		log.Fatalf("concurrency must be at least 1")
+	}
 
 	url, tok, path := *bastionURL, *token, *hostedPath
 	if tok == "" || path == "" {
@@ -43,9 +55,12 @@ func main() {
 	if info, err := os.Stat(root); err != nil || !info.IsDir() {
 		log.Fatalf("hosted-path must be an existing directory: %v", err)
 	}
+	if *watch {
+		capabilities = append(capabilities, pkg.CapWatch)
+	}
 	authFailures := 0
 	for {
-		err := runAgent(url, tok, root)
+		err := runAgent(url, tok, root, *concurrency, *watch)
 		if err == errAuthFailed {
 			authFailures++
 			if authFailures >= 3 {
@@ -139,7 +154,7 @@ func resolveDir(path string) (string, error) {
 	return filepath.Abs(path)
 }
 
-func runAgent(bastionURL, token, root string) error {
+func runAgent(bastionURL, token, root string, concurrency int, watch bool) error {
 	header := http.Header{}
 	conn, _, err := websocket.DefaultDialer.Dial(bastionURL, header)
 	if err != nil {
@@ -148,20 +163,29 @@ func runAgent(bastionURL, token, root string) error {
 	}
 	defer conn.Close()
 	// Send auth
-	if err := conn.WriteJSON(pkg.Auth{Type: pkg.TypeAuth, Token: token}); err != nil {
+	auth := pkg.Auth{
+		Type:            pkg.TypeAuth,
+		Token:           token,
+		ProtocolVersion: pkg.ProtocolVersion,
+		AgentVersion:    version,
+		Capabilities:    capabilities,
+	}
+	if err := conn.WriteJSON(auth); err != nil {
 		log.Printf("auth send: %v", err)
 		return nil
 	}
 	// Read auth response
+	conn.SetReadDeadline(time.Now().Add(pkg.PongWait))
 	_, data, err := conn.ReadMessage()
 	if err != nil {
 		log.Printf("auth read: %v", err)
 		return nil
 	}
 	var authResp struct {
-		Type    string `json:"type"`
-		AgentID string `json:"agent_id"`
-		Error   string `json:"error"`
+		Type            string `json:"type"`
+		AgentID         string `json:"agent_id"`
+		ProtocolVersion int    `json:"protocol_version"`
+		Error           string `json:"error"`
 	}
 	if err := json.Unmarshal(data, &authResp); err != nil {
 		log.Printf("auth parse: %v", err)
@@ -175,77 +199,159 @@ func runAgent(bastionURL, token, root string) error {
 		log.Printf("unexpected auth response: %s", authResp.Type)
 		return nil
 	}
-	log.Printf("blackbox agent connected (id %s)", authResp.AgentID)
+	log.Printf("blackbox agent %s connected (id %s, protocol %d)", version, authResp.AgentID, authResp.ProtocolVersion)
+	sess := newSession(conn, root, concurrency)
+	defer sess.closeAll()
+	sess.startKeepalive()
+	if watch {
+		go sess.watch()
+	}
 	// Message loop
 	for {
-		_, data, err := conn.ReadMessage()
+		msgType, data, err := conn.ReadMessage()
 		if err != nil {
 			log.Printf("read: %v", err)
 			return nil
 		}
+		sess.touch()
+		if msgType == websocket.BinaryMessage {
+			sess.routeFrame(data)
+			continue
+		}
 		var envelope struct {
-			Type string `json:"type"`
+			Type      string `json:"type"`
+			RequestID string `json:"request_id"`
 		}
 		if err := json.Unmarshal(data, &envelope); err != nil {
 			continue
 		}
 		switch envelope.Type {
-		case pkg.TypeListDir:
-			var req pkg.ListDirRequest
+		case pkg.TypeStreamOpen:
+			// Transfers are flow-controlled by bastion and run outside the worker pool.
+			var req pkg.StreamOpen
 			if json.Unmarshal(data, &req) == nil {
-				resp := handleListDir(root, &req)
-				if err := conn.WriteJSON(resp); err != nil {
-					log.Printf("write: %v", err)
-					return nil
-				}
+				ctx, done := sess.track(req.RequestID)
+				in := sess.openStream(req.RequestID)
+				go func() {
+					defer done()
+					sess.handleStream(ctx, &req, in)
+				}()
 			}
-		case pkg.TypeReadFile:
-			var req pkg.ReadFileRequest
-			if json.Unmarshal(data, &req) == nil {
-				resp := handleReadFile(root, &req)
-				if err := conn.WriteJSON(resp); err != nil {
-					log.Printf("write: %v", err)
-					return nil
+		case pkg.TypeStreamAck, pkg.TypeStreamClose:
+			sess.route(envelope.Type, data)
+		case pkg.TypeCancel:
+			sess.cancel(envelope.RequestID)
+		default:
+			// The read loop never blocks on a request, so acks keep flowing while workers are busy.
+			// Tracking starts here so a cancel that arrives while the request is queued is honored.
+			typ, reqID := envelope.Type, envelope.RequestID
+			ctx, done := sess.track(reqID)
+			queued := sess.workers.Go(func() {
+				defer done()
+				if ctx.Err() != nil {
+					return // cancelled while queued
 				}
-			}
-		case pkg.TypeWriteFile:
-			var req pkg.WriteFileRequest
-			if json.Unmarshal(data, &req) == nil {
-				resp := handleWriteFile(root, &req)
-				if err := conn.WriteJSON(resp); err != nil {
-					log.Printf("write: %v", err)
-					return nil
+				resp := sess.handleRequest(ctx, typ, reqID, data)
+				if resp == nil || ctx.Err() != nil {
+					return // bastion is no longer waiting
 				}
-			}
-		case pkg.TypeGetMeta:
-			var req pkg.GetMetaRequest
-			if json.Unmarshal(data, &req) == nil {
-				resp := handleGetMeta(root, &req)
-				if err := conn.WriteJSON(resp); err != nil {
+				if err := sess.send(resp); err != nil {
 					log.Printf("write: %v", err)
-					return nil
+					conn.Close() // ends the read loop; the agent reconnects
 				}
-			}
-		case pkg.TypeDeleteFile:
-			var req pkg.DeleteFileRequest
-			if json.Unmarshal(data, &req) == nil {
-				resp := handleDeleteFile(root, &req)
-				if err := conn.WriteJSON(resp); err != nil {
-					log.Printf("write: %v", err)
-					return nil
+			})
+			if !queued {
+				done()
+				if reqID != "" {
+					busy := pkg.ErrorResponse{Type: pkg.TypeError, RequestID: reqID, Code: pkg.ErrCodeBusy, Error: "agent busy"}
+					if err := sess.send(busy); err != nil {
+						log.Printf("write: %v", err)
+					}
 				}
 			}
-		case pkg.TypeGetDisk:
-			var req pkg.GetDiskRequest
-			if json.Unmarshal(data, &req) == nil {
-				resp := handleGetDisk(root, &req)
-				if err := conn.WriteJSON(resp); err != nil {
-					log.Printf("write: %v", err)
-					return nil
-				}
+		}
+	}
+}
+
+// handleRequest decodes and runs one request, returning the response to send (nil for none).
+func (s *session) handleRequest(ctx context.Context, typ, requestID string, data []byte) interface{} {
+	switch typ {
+	case pkg.TypeListDir:
+		var req pkg.ListDirRequest
+		if json.Unmarshal(data, &req) == nil {
+			return handleListDir(ctx, s.root, &req)
+		}
+	case pkg.TypeReadFile:
+		var req pkg.ReadFileRequest
+		if json.Unmarshal(data, &req) == nil {
+			return handleReadFile(s.root, &req)
+		}
+	case pkg.TypeWriteFile:
+		var req pkg.WriteFileRequest
+		if json.Unmarshal(data, &req) == nil {
+			return handleWriteFile(s.root, &req)
+		}
+	case pkg.TypeGetMeta:
+		var req pkg.GetMetaRequest
+		if json.Unmarshal(data, &req) == nil {
+			return handleGetMeta(s.root, &req)
+		}
+	case pkg.TypeDeleteFile:
+		var req pkg.DeleteFileRequest
+		if json.Unmarshal(data, &req) == nil {
+			return handleDeleteFile(s.root, &req)
+		}
+	case pkg.TypeGetDisk:
+		var req pkg.GetDiskRequest
+		if json.Unmarshal(data, &req) == nil {
+			return handleGetDisk(s.root, &req)
+		}
+	case pkg.TypeRename:
+		var req pkg.RenameRequest
+		if json.Unmarshal(data, &req) == nil {
+			return handleRename(ctx, s.root, &req)
+		}
+	case pkg.TypeCopy:
+		var req pkg.CopyRequest
+		if json.Unmarshal(data, &req) == nil {
+			return handleCopy(ctx, s.root, &req)
+		}
+	case pkg.TypeMkdir:
+		var req pkg.MkdirRequest
+		if json.Unmarshal(data, &req) == nil {
+			return handleMkdir(s.root, &req)
+		}
+	case pkg.TypeExtract:
+		var req pkg.ExtractRequest
+		if json.Unmarshal(data, &req) == nil {
+			return handleExtract(ctx, s.root, &req)
+		}
+	case pkg.TypeHash:
+		var req pkg.HashRequest
+		if json.Unmarshal(data, &req) == nil {
+			return s.handleHash(ctx, &req)
+		}
+	case pkg.TypeSearch:
+		var req pkg.SearchRequest
+		if json.Unmarshal(data, &req) == nil {
+			return s.handleSearch(ctx, &req)
+		}
+	case pkg.TypeUploadStat, pkg.TypeUploadCommit, pkg.TypeUploadAbort:
+		var req pkg.UploadRequest
+		if json.Unmarshal(data, &req) == nil {
+			return handleUpload(s.root, &req)
+		}
+	default:
+		if requestID != "" {
+			return pkg.ErrorResponse{
+				Type:      pkg.TypeError,
+				RequestID: requestID,
+				Code:      pkg.ErrCodeUnsupported,
+				Error:     "unsupported message type: " + typ,
 			}
 		}
 	}
+	return nil
 }
 
 // safePath returns absolute path under root, or empty string if escape.
@@ -262,7 +368,7 @@ func safePath(root, rel string) string {
 	return abs
 }
 
-func handleListDir(root string, req *pkg.ListDirRequest) pkg.ListDirResponse {
+func handleListDir(ctx context.Context, root string, req *pkg.ListDirRequest) pkg.ListDirResponse {
 	path := safePath(root, req.Path)
 	if path == "" {
 		return pkg.ListDirResponse{Type: pkg.TypeListDir, RequestID: req.RequestID, Error: "invalid path"}
@@ -273,6 +379,9 @@ func handleListDir(root string, req *pkg.ListDirRequest) pkg.ListDirResponse {
 	}
 	var out []pkg.FileEntry
 	for _, e := range entries {
+		if ctx.Err() != nil {
+			return pkg.ListDirResponse{Type: pkg.TypeListDir, RequestID: req.RequestID, Error: ctx.Err().Error()}
+		}
 		info, err := e.Info()
 		var size int64
 		var mtime string
@@ -331,7 +440,15 @@ func handleWriteFile(root string, req *pkg.WriteFileRequest) pkg.WriteFileRespon
 			return pkg.WriteFileResponse{Type: pkg.TypeWriteFile, RequestID: req.RequestID, Error: err.Error()}
 		}
 	}
-	if err := os.WriteFile(path, data, 0644); err != nil {
+	a, err := createAtomic(path)
+	if err != nil {
+		return pkg.WriteFileResponse{Type: pkg.TypeWriteFile, RequestID: req.RequestID, Error: err.Error()}
+	}
+	if _, err := a.Write(data); err != nil {
+		a.abort()
+		return pkg.WriteFileResponse{Type: pkg.TypeWriteFile, RequestID: req.RequestID, Error: err.Error()}
+	}
+	if err := a.commit(""); err != nil {
 		return pkg.WriteFileResponse{Type: pkg.TypeWriteFile, RequestID: req.RequestID, Error: err.Error()}
 	}
 	return pkg.WriteFileResponse{Type: pkg.TypeWriteFile, RequestID: req.RequestID}
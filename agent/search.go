@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"blackbox/pkg"
+)
+
+const (
+	searchDefaultLimit = 1000
+	searchMaxLimit     = 10000
+	searchMaxFileSize  = 64 << 20 // larger files are not searched for content
+	searchMaxLine      = 1 << 20  // files with longer lines are treated as binary
+	searchTextLen      = 200      // bytes of the matching line sent back
+)
+
+// searcher holds a compiled SearchRequest.
+type searcher struct {
+	name    func(string) bool
+	content func([]byte) bool
+}
+
+func newSearcher(req *pkg.SearchRequest) (*searcher, error) {
+	if req.Name == "" && req.Content == "" {
+		return nil, fmt.Errorf("name or content required")
+	}
+	s := &searcher{}
+	if req.Name != "" {
+		if req.Regex {
+			re, err := regexp.Compile(req.Name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid name pattern: %v", err)
+			}
+			s.name = re.MatchString
+		} else {
+			pattern := strings.ToLower(req.Name)
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid name pattern: %v", err)
+			}
+			s.name = func(name string) bool {
+				ok, _ := path.Match(pattern, strings.ToLower(name))
+				return ok
+			}
+		}
+	}
+	if req.Content != "" {
+		if req.Regex {
+			re, err := regexp.Compile(req.Content)
+			if err != nil {
+				return nil, fmt.Errorf("invalid content pattern: %v", err)
+			}
+			s.content = re.Match
+		} else {
+			needle := bytes.ToLower([]byte(req.Content))
+			s.content = func(line []byte) bool { return bytes.Contains(bytes.ToLower(line), needle) }
+		}
+	}
+	return s, nil
+}
+
+func (s *session) handleSearch(ctx context.Context, req *pkg.SearchRequest) pkg.SearchResponse {
+	resp := pkg.SearchResponse{Type: pkg.TypeSearch, RequestID: req.RequestID}
+	m, err := newSearcher(req)
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	root := safePath(s.root, req.Path)
+	if root == "" {
+		resp.Error = "invalid path"
+		return resp
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	if !info.IsDir() {
+		resp.Error = "not a directory"
+		return resp
+	}
+	limit := req.Limit
+	if limit <= 0 || limit > searchMaxLimit {
+		limit = searchDefaultLimit
+	}
+	var batch []pkg.SearchMatch
+	last := time.Now()
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := s.send(pkg.SearchMatches{Type: pkg.TypeSearchMatches, RequestID: req.RequestID, Matches: batch})
+		batch, last = nil, time.Now()
+		return err
+	}
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			if p == root {
+				return err
+			}
+			return nil // unreadable entries are skipped
+		}
+		if p == root {
+			return nil
+		}
+		if time.Since(last) >= partialFlush {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if m.name != nil && !m.name(d.Name()) {
+			return nil
+		}
+		if m.content != nil && !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(s.root, p)
+		match := pkg.SearchMatch{
+			Path:  filepath.ToSlash(rel),
+			IsDir: d.IsDir(),
+			Size:  info.Size(),
+			Mtime: info.ModTime().Format("2006-01-02T15:04:05Z07:00"),
+		}
+		if m.content != nil {
+			if info.Size() > searchMaxFileSize {
+				return nil
+			}
+			line, text, ok := grepFile(ctx, p, m.content)
+			if !ok {
+				return nil
+			}
+			match.Line, match.Text = line, text
+		}
+		if resp.Matches == limit {
+			resp.Truncated = true
+			return fs.SkipAll
+		}
+		resp.Matches++
+		batch = append(batch, match)
+		if len(batch) >= partialBatch {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+// grepFile returns the first line of the text file at p that matches. Files that look binary
+// (a NUL byte, or a line over searchMaxLine) do not match.
+func grepFile(ctx context.Context, p string, match func([]byte) bool) (int, string, bool) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, "", false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(ctxReader{ctx, f})
+	sc.Buffer(make([]byte, 64<<10), searchMaxLine)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Bytes()
+		if bytes.IndexByte(line, 0) >= 0 {
+			return 0, "", false
+		}
+		if match(line) {
+			return n, lineText(line), true
+		}
+	}
+	return 0, "", false
+}
+
+// lineText trims a matching line to searchTextLen bytes; a rune cut in half becomes U+FFFD.
+func lineText(line []byte) string {
+	line = bytes.TrimSpace(line)
+	if len(line) > searchTextLen {
+		line = line[:searchTextLen]
+	}
+	return strings.ToValidUTF8(string(line), "\uFFFD")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"blackbox/pkg"
+
+	"github.com/gorilla/websocket"
+)
+
+// session is one authenticated connection to bastion. Writes are serialized;
+// stream control messages are routed to the goroutine that owns the stream,
+// and every in-flight request can be cancelled by request_id.
+type session struct {
+	conn     *websocket.Conn
+	root     string
+	workers  *workerPool
+	ctx      context.Context // cancelled when the connection ends
+	stop     context.CancelFunc
+	writeMu  sync.Mutex
+	mu       sync.Mutex
+	streams  map[string]chan streamMsg
+	inflight map[string]context.CancelFunc
+}
+
+func newSession(conn *websocket.Conn, root string, concurrency int) *session {
+	ctx, stop := context.WithCancel(context.Background())
+	return &session{
+		conn:     conn,
+		root:     root,
+		workers:  newWorkerPool(concurrency),
+		ctx:      ctx,
+		stop:     stop,
+		streams:  make(map[string]chan streamMsg),
+		inflight: make(map[string]context.CancelFunc),
+	}
+}
+
+// send writes one JSON message to bastion. Safe for concurrent use.
+func (s *session) send(v interface{}) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.conn.WriteJSON(v)
+}
+
+// sendBinary writes one binary frame to bastion. Safe for concurrent use.
+func (s *session) sendBinary(frame []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.conn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+// track returns a context for requestID that is cancelled by a "cancel" message or when the
+// connection ends. Call done when the request finishes.
+func (s *session) track(requestID string) (ctx context.Context, done func()) {
+	if requestID == "" {
+		return s.ctx, func() {}
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.mu.Lock()
+	s.inflight[requestID] = cancel
+	s.mu.Unlock()
+	return ctx, func() {
+		s.mu.Lock()
+		delete(s.inflight, requestID)
+		s.mu.Unlock()
+		cancel()
+	}
+}
+
+// cancel aborts the in-flight request or stream with requestID, if any.
+func (s *session) cancel(requestID string) {
+	s.mu.Lock()
+	cancel := s.inflight[requestID]
+	s.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// openStream registers a stream so control messages for requestID are delivered to it.
+func (s *session) openStream(requestID string) <-chan streamMsg {
+	ch := make(chan streamMsg, pkg.StreamWindow+4)
+	s.mu.Lock()
+	s.streams[requestID] = ch
+	s.mu.Unlock()
+	return ch
+}
+
+func (s *session) closeStream(requestID string) {
+	s.mu.Lock()
+	delete(s.streams, requestID)
+	s.mu.Unlock()
+}
+
+// closeAll cancels in-flight work and ends every open stream; called when the connection is gone.
+func (s *session) closeAll() {
+	s.stop()
+	s.workers.close()
+	s.mu.Lock()
+	for id, ch := range s.streams {
+		close(ch)
+		delete(s.streams, id)
+	}
+	s.mu.Unlock()
+}
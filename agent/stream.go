@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"blackbox/pkg"
+)
+
+// route delivers a stream control message (JSON) from bastion.
+func (s *session) route(typ string, data []byte) {
+	var m struct {
+		RequestID string `json:"request_id"`
+		Seq       int64  `json:"seq"`
+		Error     string `json:"error"`
+		SHA256    string `json:"sha256"`
+	}
+	if json.Unmarshal(data, &m) != nil {
+		return
+	}
+	s.deliver(m.RequestID, streamMsg{Type: typ, Seq: m.Seq, Error: m.Error, SHA256: m.SHA256})
+}
+
+// routeFrame delivers a binary frame from bastion.
+func (s *session) routeFrame(data []byte) {
+	f, err := pkg.DecodeFrame(data)
+	if err != nil {
+		log.Printf("frame: %v", err)
+		return
+	}
+	if f.Type == pkg.FrameStreamChunk {
+		s.deliver(f.RequestID, streamMsg{Type: pkg.TypeStreamChunk, Seq: f.Seq, Data: f.Payload})
+	}
+}
+
+// deliver hands msg to the stream for requestID. Messages for unknown streams are dropped.
+func (s *session) deliver(requestID string, msg streamMsg) {
+	s.mu.Lock()
+	ch := s.streams[requestID]
+	if ch != nil {
+		select {
+		case ch <- msg:
+		default:
+			log.Printf("stream %s: window exceeded, dropping message", requestID)
+		}
+	}
+	s.mu.Unlock()
+}
+
+func (s *session) sendClose(requestID string, seq int64, errMsg string) {
+	if err := s.send(pkg.StreamClose{Type: pkg.TypeStreamClose, RequestID: requestID, Seq: seq, Error: errMsg}); err != nil {
+		log.Printf("write: %v", err)
+	}
+}
+
+// streamMsg is a decoded stream chunk, stream_ack or stream_close message.
+type streamMsg struct {
+	Type   string
+	Seq    int64
+	Data   []byte
+	Error  string
+	SHA256 string // stream_close of a write: expected content hash
+}
+
+// handleStream runs a chunked transfer until it completes, fails, or is aborted. Run in goroutine.
+func (s *session) handleStream(ctx context.Context, req *pkg.StreamOpen, in <-chan streamMsg) {
+	defer s.closeStream(req.RequestID)
+	switch req.Op {
+	case pkg.StreamOpRead:
+		s.streamRead(ctx, req, in)
+	case pkg.StreamOpWrite:
+		s.streamWrite(ctx, req, in)
+	default:
+		s.sendClose(req.RequestID, 0, "unsupported stream op")
+	}
+}
+
+func (s *session) streamRead(ctx context.Context, req *pkg.StreamOpen, in <-chan streamMsg) {
+	path := safePath(s.root, req.Path)
+	if path == "" {
+		s.sendClose(req.RequestID, 0, "invalid path")
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		s.sendClose(req.RequestID, 0, err.Error())
+		return
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil {
+		s.sendClose(req.RequestID, 0, err.Error())
+		return
+	} else if info.IsDir() {
+		s.sendClose(req.RequestID, 0, "is a directory")
+		return
+	}
+	if req.Offset > 0 {
+		if _, err := f.Seek(req.Offset, io.SeekStart); err != nil {
+			s.sendClose(req.RequestID, 0, err.Error())
+			return
+		}
+	}
+	var r io.Reader = f
+	if req.Size > 0 {
+		r = io.LimitReader(f, req.Size)
+	}
+	// File data is read straight into the frame buffer after the header.
+	hdrLen := pkg.FrameHeaderLen(req.RequestID)
+	buf := make([]byte, hdrLen+pkg.StreamChunkSize)
+	var seq, acked int64
+	for {
+		var ok bool
+		if acked, ok = awaitWindow(ctx, in, seq, acked); !ok {
+			return // aborted or cancelled by bastion, or connection closed
+		}
+		n, err := io.ReadFull(r, buf[hdrLen:])
+		if n > 0 {
+			seq++
+			if _, herr := pkg.AppendFrameHeader(buf[:0], pkg.FrameStreamChunk, req.RequestID, seq); herr != nil {
+				s.sendClose(req.RequestID, seq-1, herr.Error())
+				return
+			}
+			if err := s.sendBinary(buf[:hdrLen+n]); err != nil {
+				log.Printf("write: %v", err)
+				return
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			s.sendClose(req.RequestID, seq, "")
+			return
+		}
+		if err != nil {
+			s.sendClose(req.RequestID, seq, err.Error())
+			return
+		}
+	}
+}
+
+// awaitWindow consumes pending acks, blocking while the window is full. It returns the
+// updated ack position, or false if the stream was aborted, cancelled or the connection closed.
+func awaitWindow(ctx context.Context, in <-chan streamMsg, seq, acked int64) (int64, bool) {
+	for {
+		if ctx.Err() != nil {
+			return acked, false
+		}
+		var msg streamMsg
+		var ok bool
+		if seq-acked >= pkg.StreamWindow {
+			select {
+			case msg, ok = <-in:
+			case <-ctx.Done():
+				return acked, false
+			}
+		} else {
+			select {
+			case msg, ok = <-in:
+			default:
+				return acked, true
+			}
+		}
+		if !ok || msg.Type == pkg.TypeStreamClose {
+			return acked, false
+		}
+		if msg.Type == pkg.TypeStreamAck && msg.Seq > acked {
+			acked = msg.Seq
+		}
+	}
+}
+
+// writeSink is where a write stream's chunks go: an atomic replacement of the
+// destination, or the partial file of a resumable upload.
+type writeSink interface {
+	Write(p []byte) (int, error)
+	commit(wantSHA256 string) error
+	abort()
+}
+
+// uploadSink appends to an upload's partial file. Both commit and abort keep the data on
+// disk: the upload is only moved into place by upload_commit.
+type uploadSink struct {
+	f *os.File
+}
+
+func (u *uploadSink) Write(p []byte) (int, error) { return u.f.Write(p) }
+
+func (u *uploadSink) commit(string) error {
+	if err := u.f.Sync(); err != nil {
+		u.f.Close()
+		return err
+	}
+	return u.f.Close()
+}
+
+func (u *uploadSink) abort() {
+	u.f.Sync()
+	u.f.Close()
+}
+
+func (s *session) streamWrite(ctx context.Context, req *pkg.StreamOpen, in <-chan streamMsg) {
+	path := safePath(s.root, req.Path)
+	if path == "" {
+		s.sendClose(req.RequestID, 0, "invalid path")
+		return
+	}
+	if dir := filepath.Dir(path); dir != path {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			s.sendClose(req.RequestID, 0, err.Error())
+			return
+		}
+	}
+	var sink writeSink
+	if req.UploadID != "" {
+		if !validUploadID(req.UploadID) {
+			s.sendClose(req.RequestID, 0, "invalid upload id")
+			return
+		}
+		f, err := openUploadPart(uploadPartPath(path, req.UploadID), req.Offset)
+		if err != nil {
+			s.sendClose(req.RequestID, 0, err.Error())
+			return
+		}
+		sink = &uploadSink{f: f}
+	} else {
+		if req.NoReplace {
+			if _, err := os.Lstat(path); err == nil {
+				s.sendClose(req.RequestID, 0, pkg.StreamErrExists)
+				return
+			}
+		}
+		a, err := createAtomic(path)
+		if err != nil {
+			s.sendClose(req.RequestID, 0, err.Error())
+			return
+		}
+		a.noReplace = req.NoReplace
+		sink = a
+	}
+	fail := func(seq int64, msg string) {
+		sink.abort()
+		if msg != "" {
+			s.sendClose(req.RequestID, seq, msg)
+		}
+	}
+	if err := s.send(pkg.StreamAck{Type: pkg.TypeStreamAck, RequestID: req.RequestID}); err != nil {
+		log.Printf("write: %v", err)
+		fail(0, "")
+		return
+	}
+	var seq int64
+	for {
+		var msg streamMsg
+		var ok bool
+		select {
+		case msg, ok = <-in:
+		case <-ctx.Done():
+		}
+		if !ok {
+			fail(seq, "") // cancelled or connection closed
+			return
+		}
+		switch msg.Type {
+		case pkg.TypeStreamChunk:
+			if msg.Seq != seq+1 {
+				fail(seq, fmt.Sprintf("out of order chunk %d (expected %d)", msg.Seq, seq+1))
+				return
+			}
+			if _, err := sink.Write(msg.Data); err != nil {
+				fail(seq, err.Error())
+				return
+			}
+			seq = msg.Seq
+			if err := s.send(pkg.StreamAck{Type: pkg.TypeStreamAck, RequestID: req.RequestID, Seq: seq}); err != nil {
+				log.Printf("write: %v", err)
+				fail(seq, "")
+				return
+			}
+		case pkg.TypeStreamClose:
+			if msg.Error != "" {
+				fail(seq, "") // aborted by bastion
+				return
+			}
+			if msg.Seq != seq {
+				fail(seq, fmt.Sprintf("stream ended at chunk %d, received %d", msg.Seq, seq))
+				return
+			}
+			if err := sink.commit(msg.SHA256); err != nil {
+				s.sendClose(req.RequestID, seq, err.Error())
+				return
+			}
+			s.sendClose(req.RequestID, seq, "")
+			return
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"blackbox/pkg"
+)
+
+// uploadPartPath returns the partial file of a resumable upload to path. It lives in the
+// destination directory so the final rename stays on one filesystem.
+func uploadPartPath(path, uploadID string) string {
+	return filepath.Join(filepath.Dir(path), ".blackbox-upload-"+uploadID+".part")
+}
+
+// validUploadID accepts the UUIDs bastion issues; anything else could escape the directory.
+func validUploadID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// openUploadPart opens the partial file for appending at offset. Bytes past offset (from a
+// transfer that was cut off before bastion recorded them) are dropped; the client resends them.
+func openUploadPart(part string, offset int64) (*os.File, error) {
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.Size() < offset {
+		f.Close()
+		return nil, fmt.Errorf("offset %d beyond received bytes %d", offset, info.Size())
+	}
+	if info.Size() > offset {
+		if err := f.Truncate(offset); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func handleUpload(root string, req *pkg.UploadRequest) pkg.UploadResponse {
+	resp := pkg.UploadResponse{Type: req.Type, RequestID: req.RequestID}
+	path := safePath(root, req.Path)
+	if path == "" {
+		resp.Error = "invalid path"
+		return resp
+	}
+	if !validUploadID(req.UploadID) {
+		resp.Error = "invalid upload id"
+		return resp
+	}
+	part := uploadPartPath(path, req.UploadID)
+	switch req.Type {
+	case pkg.TypeUploadStat:
+		info, err := os.Stat(part)
+		if os.IsNotExist(err) {
+			return resp // nothing received yet
+		}
+		if err != nil {
+			resp.Error = err.Error()
+			return resp
+		}
+		resp.Size = info.Size()
+	case pkg.TypeUploadCommit:
+		info, err := os.Stat(part)
+		if os.IsNotExist(err) {
+			// Zero-length uploads never open a stream, so there may be no partial file.
+			if err := os.MkdirAll(filepath.Dir(part), 0755); err != nil {
+				resp.Error = err.Error()
+				return resp
+			}
+			if f, cerr := os.Create(part); cerr == nil {
+				f.Close()
+			} else {
+				resp.Error = cerr.Error()
+				return resp
+			}
+		} else if err != nil {
+			resp.Error = err.Error()
+			return resp
+		} else {
+			resp.Size = info.Size()
+		}
+		if req.SHA256 != "" {
+			got, err := fileSHA256(part)
+			if err != nil {
+				resp.Error = err.Error()
+				return resp
+			}
+			if !strings.EqualFold(got, req.SHA256) {
+				resp.Error = "checksum mismatch: got sha256 " + got
+				return resp
+			}
+		}
+		if err := os.Rename(part, path); err != nil {
+			resp.Error = err.Error()
+			return resp
+		}
+		syncDir(filepath.Dir(path))
+	case pkg.TypeUploadAbort:
+		if err := os.Remove(part); err != nil && !os.IsNotExist(err) {
+			resp.Error = err.Error()
+		}
+	}
+	return resp
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"blackbox/pkg"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	watchFlush      = 500 * time.Millisecond // events are coalesced this long before they are sent
+	watchBatch      = 1000                   // events per fs_event message
+	watchMaxPending = 10000                  // beyond this, one overflow event replaces the backlog
+)
+
+// watcher turns fsnotify events below the hosted root into fs_event messages. fsnotify is not
+// recursive, so every directory gets its own watch, added as directories appear.
+type watcher struct {
+	s       *session
+	fw      *fsnotify.Watcher
+	full    bool // a watch could not be added (e.g. inotify limit); the tree is only partly watched
+	pending []pkg.FsEvent
+	index   map[string]int // path -> position in pending
+}
+
+// watch runs until the session ends. Run in goroutine.
+func (s *session) watch() {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("watch: %v", err)
+		return
+	}
+	defer fw.Close()
+	w := &watcher{s: s, fw: fw, index: make(map[string]int)}
+	w.addTree(s.root, false)
+	t := time.NewTicker(watchFlush)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case ev, ok := <-fw.Events:
+			if !ok {
+				return
+			}
+			w.handle(ev)
+		case err, ok := <-fw.Errors:
+			if !ok {
+				return
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				w.overflow()
+			} else {
+				log.Printf("watch: %v", err)
+			}
+		case <-t.C:
+			if err := w.flush(); err != nil {
+				return // the connection is gone; the session is ending
+			}
+		}
+	}
+}
+
+func (w *watcher) handle(ev fsnotify.Event) {
+	if isInternalName(filepath.Base(ev.Name)) {
+		return
+	}
+	rel, err := filepath.Rel(w.s.root, ev.Name)
+	if err != nil || rel == "." {
+		return
+	}
+	e := pkg.FsEvent{Path: filepath.ToSlash(rel)}
+	switch {
+	case ev.Has(fsnotify.Create):
+		e.Op = pkg.FsCreate
+		if info, err := os.Lstat(ev.Name); err == nil && info.IsDir() {
+			e.IsDir = true
+			w.add(e)
+			// Entries created before the watch was in place (or moved in with the directory)
+			// produce no events of their own.
+			w.addTree(ev.Name, true)
+			return
+		}
+	case ev.Has(fsnotify.Write):
+		e.Op = pkg.FsModify
+	case ev.Has(fsnotify.Remove):
+		e.Op = pkg.FsDelete
+		w.unwatch(ev.Name)
+	case ev.Has(fsnotify.Rename):
+		e.Op = pkg.FsRename
+		w.unwatch(ev.Name)
+	default:
+		return // chmod only
+	}
+	w.add(e)
+}
+
+// addTree watches dir and every directory below it. With report, the entries found are
+// queued as creates.
+func (w *watcher) addTree(dir string, report bool) {
+	_ = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || isInternalName(d.Name()) {
+			return nil
+		}
+		if report && p != dir {
+			rel, _ := filepath.Rel(w.s.root, p)
+			w.add(pkg.FsEvent{Op: pkg.FsCreate, Path: filepath.ToSlash(rel), IsDir: d.IsDir()})
+		}
+		if !d.IsDir() || w.full {
+			return nil
+		}
+		if err := w.fw.Add(p); err != nil {
+			w.full = true
+			log.Printf("watch: %s: %v; changes below some directories will not be reported", p, err)
+		}
+		return nil
+	})
+}
+
+// unwatch drops the watches on dir and below it. fsnotify names events by the path a watch
+// was added with, so watches on a moved directory would report its old paths; the create for
+// the new name watches it again.
+func (w *watcher) unwatch(dir string) {
+	prefix := dir + string(filepath.Separator)
+	for _, p := range w.fw.WatchList() {
+		if p == dir || strings.HasPrefix(p, prefix) {
+			_ = w.fw.Remove(p)
+		}
+	}
+}
+
+// add queues e, merging it with a pending event for the same path: the latest operation wins,
+// except that a modify does not hide the create before it.
+func (w *watcher) add(e pkg.FsEvent) {
+	if i, ok := w.index[e.Path]; ok {
+		if w.pending[i].Op == pkg.FsOverflow || (w.pending[i].Op == pkg.FsCreate && e.Op == pkg.FsModify) {
+			return
+		}
+		w.pending[i] = e
+		return
+	}
+	if len(w.pending) >= watchMaxPending {
+		w.overflow()
+		return
+	}
+	w.index[e.Path] = len(w.pending)
+	w.pending = append(w.pending, e)
+}
+
+// overflow replaces everything pending with a single overflow event.
+func (w *watcher) overflow() {
+	w.pending = []pkg.FsEvent{{Op: pkg.FsOverflow}}
+	w.index = map[string]int{"": 0}
+}
+
+func (w *watcher) flush() error {
+	for len(w.pending) > 0 {
+		n := min(len(w.pending), watchBatch)
+		if err := w.s.send(pkg.FsEvents{Type: pkg.TypeFsEvent, Events: w.pending[:n]}); err != nil {
+			return err
+		}
+		w.pending = w.pending[n:]
+	}
+	w.pending = nil
+	clear(w.index)
+	return nil
+}
+
+// isInternalName reports the agent's own temporary files: atomic write temps and partial uploads.
+func isInternalName(name string) bool {
+	return strings.HasPrefix(name, ".blackbox-upload-") ||
+		(strings.HasPrefix(name, ".") && strings.Contains(name, ".blackbox-") && strings.HasSuffix(name, ".tmp"))
+}
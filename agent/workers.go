@@ -0,0 +1,38 @@
+package main
+
+// workerQueue is how many requests per worker may wait for one to be free.
+const workerQueue = 4
+
+// workerPool runs request handlers on n long-lived workers. Up to workerQueue*n more wait
+// in a queue; beyond that Go refuses work, so a burst of requests cannot pile up goroutines
+// and payloads without limit.
+type workerPool struct {
+	work chan func()
+}
+
+func newWorkerPool(n int) *workerPool {
+	p := &workerPool{work: make(chan func(), workerQueue*n)}
+	for i := 0; i < n; i++ {
+		go func() {
+			for fn := range p.work {
+				fn()
+			}
+		}()
+	}
+	return p
+}
+
+// Go queues fn for a worker and reports whether there was room. It never blocks.
+func (p *workerPool) Go(fn func()) bool {
+	select {
+	case p.work <- fn:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops the workers once the queued work is done. Go must not be called after.
+func (p *workerPool) close() {
+	close(p.work)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
@@ -26,7 +27,7 @@ func (s *Server) HandleAgentWS(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	conn.SetReadDeadline(time.Time{}) // no deadline for rest of session
+	conn.SetReadDeadline(time.Time{}) // startKeepalive sets the deadline once registered
 	var auth pkg.Auth
 	if err := json.Unmarshal(data, &auth); err != nil || auth.Type != pkg.TypeAuth {
 		if err := conn.WriteJSON(pkg.AuthError{Type: pkg.TypeAuthError, Error: "invalid auth message"}); err != nil {
@@ -42,11 +43,28 @@ func (s *Server) HandleAgentWS(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	ac := s.hub.Register(agentID, conn)
-	defer s.hub.Unregister(agentID)
-	if err := conn.WriteJSON(pkg.AuthOK{Type: pkg.TypeAuthOK, AgentID: agentID}); err != nil {
+	caps := auth.Capabilities
+	if caps == nil {
+		caps = []string{}
+	}
+	_, err = s.pool.Exec(r.Context(),
+		`UPDATE agents SET protocol_version = $1, agent_version = $2, capabilities = $3 WHERE id::text = $4`,
+		auth.ProtocolVersion, auth.AgentVersion, caps, agentID)
+	if err != nil {
+		log.Printf("agent ws: save handshake for %s: %v", agentID, err)
+	}
+	// auth_ok goes out before the agent is registered: until then nothing else writes to conn,
+	// and no request can reach the agent ahead of it.
+	if err := conn.WriteJSON(pkg.AuthOK{Type: pkg.TypeAuthOK, AgentID: agentID, ProtocolVersion: pkg.ProtocolVersion}); err != nil {
 		log.Printf("agent ws: write auth ok: %v", err)
 		return
 	}
-	ac.readLoop(s.hub)
+	ac := s.hub.Register(agentID, conn, auth)
+	defer s.hub.remove(ac)
+	s.recordConnect(r.Context(), ac, r, auth)
+	go s.resumeJobs(context.Background(), agentID)
+	go s.pollDisk(ac)
+	ac.startKeepalive()
+	err = ac.readLoop(s.hub)
+	s.recordDisconnect(ac, err)
 }
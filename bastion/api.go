@@ -11,6 +11,7 @@ import (
 	"blackbox/pkg"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 )
 
 func (s *Server) Me(w http.ResponseWriter, r *http.Request) {
@@ -20,43 +21,82 @@ func (s *Server) Me(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(map[string]string{
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
 		"user_id":  claims.UserID,
 		"username": claims.Username,
+		"admin":    claims.siteAdmin(),
 	})
 }
 
+// ListAgents lists the agents the user was granted access to (all of them for admins).
+// GET /api/agents
 func (s *Server) ListAgents(w http.ResponseWriter, r *http.Request) {
+	claims := ClaimsFromContext(r.Context())
+	acc, err := s.userAccess(r.Context(), claims, "")
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
 	rows, err := s.pool.Query(r.Context(),
-		`SELECT id::text, label, hosted_path, created_at FROM agents ORDER BY label`)
+		`SELECT a.id::text, a.label, a.hosted_path, a.created_at, a.protocol_version, a.agent_version, a.capabilities, a.indexed_at,
+			a.last_seen, `+uptimeSeconds+`, GREATEST(a.created_at, $1)
+		 FROM agents a ORDER BY a.label`, time.Now().Add(-uptimeWindow))
 	if err != nil {
 		writeJSONError(w, http.StatusInternalServerError, "internal error")
 		return
 	}
 	defer rows.Close()
 	type agentRow struct {
-		ID           string  `json:"id"`
-		Label        string  `json:"label"`
-		HostedPath   string  `json:"hosted_path"`
-		Connected    bool    `json:"connected"`
-		DiskFree     *int64  `json:"disk_free,omitempty"`
-		DiskTotal    *int64  `json:"disk_total,omitempty"`
+		ID              string     `json:"id"`
+		Label           string     `json:"label"`
+		HostedPath      string     `json:"hosted_path"`
+		Connected       bool       `json:"connected"`
+		DiskFree        *int64     `json:"disk_free,omitempty"`
+		DiskTotal       *int64     `json:"disk_total,omitempty"`
+		ProtocolVersion int        `json:"protocol_version"`
+		AgentVersion    string     `json:"agent_version,omitempty"`
+		Capabilities    []string   `json:"capabilities"`
+		IndexedAt       *time.Time `json:"indexed_at"`          // last file index pass; listings of an offline agent come from it
+		LastSeen        *time.Time `json:"last_seen,omitempty"` // last traffic from the agent
+		RTTMillis       *float64   `json:"rtt_ms,omitempty"`    // round-trip time of the last keepalive ping
+		Uptime          float64    `json:"uptime"`              // percent of the last 7 days (or since created) connected
+		Permissions     []grant    `json:"permissions"`         // the user's grants on the agent
 	}
 	var list []agentRow
 	for rows.Next() {
-		var id, label, hostedPath string
+		var id, label, hostedPath, agentVersion string
 		var createdAt interface{}
-		if err := rows.Scan(&id, &label, &hostedPath, &createdAt); err != nil {
+		var protocolVersion int
+		var caps []string
+		var indexedAt, lastSeen *time.Time
+		var upSeconds float64
+		var upSince time.Time
+		if err := rows.Scan(&id, &label, &hostedPath, &createdAt, &protocolVersion, &agentVersion, &caps, &indexedAt,
+			&lastSeen, &upSeconds, &upSince); err != nil {
 			writeJSONError(w, http.StatusInternalServerError, "internal error")
 			return
 		}
-		connected := s.hub.Connected(id)
-		row := agentRow{ID: id, Label: label, HostedPath: hostedPath, Connected: connected}
-		if connected {
-			if free, total := s.getAgentDisk(r.Context(), id); free >= 0 && total >= 0 {
+		a := accessTo(acc, claims, id)
+		if !a.visible() {
+			continue
+		}
+		ac := s.hub.Get(id)
+		row := agentRow{
+			ID: id, Label: label, HostedPath: hostedPath, Connected: ac != nil,
+			ProtocolVersion: protocolVersion, AgentVersion: agentVersion, Capabilities: caps, IndexedAt: indexedAt,
+			LastSeen: lastSeen, Uptime: uptimePercent(upSeconds, upSince), Permissions: a.grantsJSON(),
+		}
+		if ac != nil {
+			if free, total, ok := ac.Disk(); ok {
 				row.DiskFree = &free
 				row.DiskTotal = &total
 			}
+			seen, rtt := ac.LastSeen()
+			row.LastSeen = &seen
+			if rtt > 0 {
+				ms := float64(rtt.Microseconds()) / 1000
+				row.RTTMillis = &ms
+			}
 		}
 		list = append(list, row)
 	}
@@ -72,12 +112,32 @@ func (s *Server) ListAgents(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(list)
 }
 
-// getAgentDisk returns free and total bytes for the agent's volume, or -1,-1 on failure.
-func (s *Server) getAgentDisk(ctx context.Context, agentID string) (free, total int64) {
-	ac := s.hub.Get(agentID)
-	if ac == nil {
-		return -1, -1
+// diskInterval is how often connected agents are asked for their disk usage. ListAgents
+// serves the last answer, so listing agents never waits on them.
+const diskInterval = 30 * time.Second
+
+// pollDisk keeps ac's disk usage current until it disconnects, publishing each change.
+// Run in goroutine.
+func (s *Server) pollDisk(ac *AgentConn) {
+	t := time.NewTicker(diskInterval)
+	defer t.Stop()
+	for {
+		if free, total := getAgentDisk(context.Background(), ac); free >= 0 && total >= 0 {
+			d := diskEvent{Free: free, Total: total}
+			if ac.setDisk(d) {
+				s.hub.events.publish(Event{Type: eventDisk, AgentID: ac.AgentID, Data: d})
+			}
+		}
+		select {
+		case <-ac.done:
+			return
+		case <-t.C:
+		}
 	}
+}
+
+// getAgentDisk returns free and total bytes for the agent's volume, or -1,-1 on failure.
+func getAgentDisk(ctx context.Context, ac *AgentConn) (free, total int64) {
 	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
 	defer cancel()
 	reqID := uuid.New().String()
@@ -94,7 +154,13 @@ func (s *Server) getAgentDisk(ctx context.Context, agentID string) (free, total
 }
 
 // CreateAgent creates a new agent; returns agent id and token (show token only on create).
+// The user who creates it becomes its admin.
 func (s *Server) CreateAgent(w http.ResponseWriter, r *http.Request) {
+	// The new agent would be outside any scope, and its connect token a way around read-only.
+	if ClaimsFromContext(r.Context()).limited() {
+		writeJSONError(w, http.StatusForbidden, "not allowed with a read-only or scoped API token")
+		return
+	}
 	var req struct {
 		Label      string `json:"label"`
 		HostedPath string `json:"hosted_path"`
@@ -117,10 +183,18 @@ func (s *Server) CreateAgent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var id string
-	err = s.pool.QueryRow(r.Context(),
-		`INSERT INTO agents (label, token, hosted_path) VALUES ($1, $2, $3) RETURNING id::text`,
-		req.Label, token, hostedPath,
-	).Scan(&id)
+	err = pgx.BeginFunc(r.Context(), s.pool, func(tx pgx.Tx) error {
+		err := tx.QueryRow(r.Context(),
+			`INSERT INTO agents (label, token, hosted_path) VALUES ($1, $2, $3) RETURNING id::text`,
+			req.Label, token, hostedPath,
+		).Scan(&id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(r.Context(), `INSERT INTO agent_permissions (user_id, agent_id, path, level) VALUES ($1, $2, '.', $3)`,
+			ClaimsFromContext(r.Context()).UserID, id, permAdmin.String())
+		return err
+	})
 	if err != nil {
 		writeJSONError(w, http.StatusInternalServerError, "internal error")
 		return
@@ -153,6 +227,9 @@ func (s *Server) UpdateAgent(w http.ResponseWriter, r *http.Request) {
 		writeJSONError(w, http.StatusBadRequest, "label required")
 		return
 	}
+	if _, ok := s.authorize(w, r, agentID, permAdmin, "."); !ok {
+		return
+	}
 	result, err := s.pool.Exec(r.Context(), `UPDATE agents SET label = $1 WHERE id::text = $2`, *req.Label, agentID)
 	if err != nil {
 		writeJSONError(w, http.StatusInternalServerError, "internal error")
@@ -172,6 +249,9 @@ func (s *Server) DeleteAgent(w http.ResponseWriter, r *http.Request) {
 		writeJSONError(w, http.StatusBadRequest, "agent id required")
 		return
 	}
+	if _, ok := s.authorize(w, r, agentID, permAdmin, "."); !ok {
+		return
+	}
 	s.hub.Unregister(agentID)
 	result, err := s.pool.Exec(r.Context(), `DELETE FROM agents WHERE id::text = $1`, agentID)
 	if err != nil {
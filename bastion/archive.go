@@ -0,0 +1,168 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"blackbox/pkg"
+)
+
+// Archive formats for download=1&format=...
+const (
+	archiveZip   = "zip"
+	archiveTarGz = "tar.gz"
+)
+
+// archiveWriter adds entries to a zip or tar.gz stream.
+type archiveWriter interface {
+	dir(name string, mtime time.Time) error
+	// file writes size bytes from r; tar needs the size up front.
+	file(name string, size int64, mtime time.Time, r io.Reader) error
+	Close() error
+}
+
+// proxyArchive streams the file or directory tree at root as an archive built on the fly:
+// bastion walks list_dir and pipes each file's read stream into the archive, so nothing is
+// staged on disk or held in memory beyond one chunk. Once the response has started, an error
+// aborts the connection so the client sees a truncated download rather than a valid archive.
+func (s *Server) proxyArchive(ctx context.Context, w http.ResponseWriter, r *http.Request, ac *AgentConn, root, format string, meta *pkg.GetMetaResponse) {
+	if format != archiveZip && format != archiveTarGz {
+		writeJSONError(w, http.StatusBadRequest, "format must be zip or tar.gz")
+		return
+	}
+	name := path.Base(path.Clean("/" + root))
+	if name == "/" {
+		name = "files"
+	}
+	ctype := "application/zip"
+	if format == archiveTarGz {
+		ctype = "application/gzip"
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + "." + format}))
+	if r.Method == http.MethodHead {
+		return
+	}
+	var aw archiveWriter
+	if format == archiveZip {
+		aw = &zipArchive{zw: zip.NewWriter(w)}
+	} else {
+		gz := gzip.NewWriter(w)
+		aw = &tarArchive{gz: gz, tw: tar.NewWriter(gz)}
+	}
+	err := s.writeArchive(ctx, aw, ac, root, name, meta)
+	if err == nil {
+		err = aw.Close()
+	}
+	if errors.Is(err, errDownloadLimit) {
+		return // a share download answered 410 instead
+	}
+	if err != nil {
+		log.Printf("archive %s on agent %s: %v", root, ac.AgentID, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (s *Server) writeArchive(ctx context.Context, aw archiveWriter, ac *AgentConn, root, name string, meta *pkg.GetMetaResponse) error {
+	if !meta.IsDir {
+		return archiveFile(ctx, aw, ac, root, name, pkg.FileEntry{Name: name, Size: meta.Size, Mtime: meta.Mtime})
+	}
+	mtime, _ := time.Parse(time.RFC3339, meta.Mtime)
+	if err := aw.dir(name+"/", mtime); err != nil {
+		return err
+	}
+	return s.walkTree(ctx, ac, root, func(rel string, e pkg.FileEntry) error {
+		entryName := path.Join(name, rel)
+		if e.IsDir {
+			mtime, _ := time.Parse(time.RFC3339, e.Mtime)
+			return aw.dir(entryName+"/", mtime)
+		}
+		return archiveFile(ctx, aw, ac, path.Join(root, rel), entryName, e)
+	})
+}
+
+// archiveFile adds one file. Files that cannot be opened (removed since the listing, symlinks
+// to directories, permission errors) are skipped; the stream is opened before the entry header
+// is written, so skipping leaves the archive intact.
+func archiveFile(ctx context.Context, aw archiveWriter, ac *AgentConn, src, name string, e pkg.FileEntry) error {
+	rc, err := ac.OpenRead(ctx, src, 0, e.Size)
+	if err != nil {
+		if ctx.Err() != nil || isAgentOffline(err) {
+			return err
+		}
+		log.Printf("archive: skipping %s on agent %s: %v", src, ac.AgentID, err)
+		return nil
+	}
+	defer rc.Close()
+	mtime, _ := time.Parse(time.RFC3339, e.Mtime)
+	if err := aw.file(name, e.Size, mtime, rc); err != nil {
+		return fmt.Errorf("%s: %w", src, err)
+	}
+	return nil
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchive) dir(name string, mtime time.Time) error {
+	h := &zip.FileHeader{Name: name, Modified: mtime}
+	h.SetMode(os.ModeDir | 0755)
+	_, err := a.zw.CreateHeader(h)
+	return err
+}
+
+func (a *zipArchive) file(name string, size int64, mtime time.Time, r io.Reader) error {
+	h := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: mtime}
+	h.SetMode(0644)
+	fw, err := a.zw.CreateHeader(h)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(fw, r)
+	if err == nil && n != size {
+		err = fmt.Errorf("size changed while reading (%d of %d bytes)", n, size)
+	}
+	return err
+}
+
+func (a *zipArchive) Close() error { return a.zw.Close() }
+
+type tarArchive struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func (a *tarArchive) dir(name string, mtime time.Time) error {
+	return a.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: 0755, ModTime: mtime})
+}
+
+func (a *tarArchive) file(name string, size int64, mtime time.Time, r io.Reader) error {
+	err := a.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Size: size, Mode: 0644, ModTime: mtime})
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(a.tw, r)
+	if err == nil && n != size {
+		err = fmt.Errorf("size changed while reading (%d of %d bytes)", n, size)
+	}
+	return err
+}
+
+func (a *tarArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
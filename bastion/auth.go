@@ -13,12 +13,23 @@ type User struct {
 	ID           string
 	Username     string
 	PasswordHash string
+	TOTPSecret   string // empty unless 2FA is enabled
+	TOTPLastStep int64  // last TOTP time step used to log in
+	Admin        bool   // manages users and may do everything on every agent
 }
 
+// SessionClaims are the claims of a session token. The registered ID (jti) names the
+// session's row in the sessions table.
 type SessionClaims struct {
 	jwt.RegisteredClaims
 	UserID   string `json:"user_id"`
 	Username string `json:"username"`
+	// SessionID is the sessions row ID and Admin the user's current admin flag, both set
+	// by AuthMiddleware.
+	SessionID string `json:"-"`
+	Admin     bool   `json:"-"`
+	// Token is set instead of SessionID when the request used an API token.
+	Token *apiToken `json:"-"`
 }
 
 func HashPassword(password string) (string, error) {
@@ -33,20 +44,20 @@ func CheckPassword(hash, password string) bool {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
 }
 
-func CreateUser(ctx context.Context, pool *pgxpool.Pool, username, password string) (*User, error) {
+func CreateUser(ctx context.Context, pool *pgxpool.Pool, username, password string, admin bool) (*User, error) {
 	hash, err := HashPassword(password)
 	if err != nil {
 		return nil, err
 	}
 	var id string
 	err = pool.QueryRow(ctx,
-		`INSERT INTO users (username, password_hash) VALUES ($1, $2) RETURNING id`,
-		username, hash,
+		`INSERT INTO users (username, password_hash, is_admin) VALUES ($1, $2, $3) RETURNING id`,
+		username, hash, admin,
 	).Scan(&id)
 	if err != nil {
 		return nil, err
 	}
-	return &User{ID: id, Username: username, PasswordHash: hash}, nil
+	return &User{ID: id, Username: username, PasswordHash: hash, Admin: admin}, nil
 }
 
 func HasAnyUser(ctx context.Context, pool *pgxpool.Pool) (bool, error) {
@@ -59,20 +70,30 @@ func HasAnyUser(ctx context.Context, pool *pgxpool.Pool) (bool, error) {
 }
 
 func GetUserByUsername(ctx context.Context, pool *pgxpool.Pool, username string) (*User, error) {
+	return getUser(ctx, pool, `username = $1`, username)
+}
+
+func GetUserByID(ctx context.Context, pool *pgxpool.Pool, id string) (*User, error) {
+	return getUser(ctx, pool, `id::text = $1`, id)
+}
+
+// getUser loads the user matching where, a condition on one parameter.
+func getUser(ctx context.Context, pool *pgxpool.Pool, where string, arg string) (*User, error) {
 	var u User
 	err := pool.QueryRow(ctx,
-		`SELECT id, username, password_hash FROM users WHERE username = $1`,
-		username,
-	).Scan(&u.ID, &u.Username, &u.PasswordHash)
+		`SELECT id, username, password_hash, COALESCE(totp_secret, ''), totp_last_step, is_admin FROM users WHERE `+where,
+		arg,
+	).Scan(&u.ID, &u.Username, &u.PasswordHash, &u.TOTPSecret, &u.TOTPLastStep, &u.Admin)
 	if err != nil {
 		return nil, err
 	}
 	return &u, nil
 }
 
-func IssueToken(userID, username, jwtSecret string, expiresIn time.Duration) (string, error) {
+func IssueToken(jti, userID, username, jwtSecret string, expiresIn time.Duration) (string, error) {
 	claims := SessionClaims{
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiresIn)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
@@ -94,7 +115,7 @@ func ValidateToken(tokenString, jwtSecret string) (*SessionClaims, error) {
 		return nil, err
 	}
 	claims, ok := t.Claims.(*SessionClaims)
-	if !ok || !t.Valid {
+	if !ok || !t.Valid || claims.ID == "" {
 		return nil, jwt.ErrTokenInvalidClaims
 	}
 	return claims, nil
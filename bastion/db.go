@@ -4,6 +4,8 @@ import (
 	"context"
 	"embed"
 	"fmt"
+	"io/fs"
+	"sort"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 )
@@ -23,11 +25,22 @@ func OpenDB(ctx context.Context, databaseURL string) (*pgxpool.Pool, error) {
 	return pool, nil
 }
 
+// RunMigrations runs every embedded migration in file name order. Migrations must be idempotent
+// (IF NOT EXISTS) since all of them run on every start.
 func RunMigrations(ctx context.Context, pool *pgxpool.Pool) error {
-	sql, err := migrationsFS.ReadFile("migrations/001_init.sql")
+	names, err := fs.Glob(migrationsFS, "migrations/*.sql")
 	if err != nil {
 		return err
 	}
-	_, err = pool.Exec(ctx, string(sql))
-	return err
+	sort.Strings(names)
+	for _, name := range names {
+		sql, err := migrationsFS.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if _, err := pool.Exec(ctx, string(sql)); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
 }
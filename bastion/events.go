@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"blackbox/pkg"
+)
+
+// Event types published on the hub's broker.
+const (
+	eventAgent = "agent" // an agent connected or disconnected; Data is agentEvent
+	eventDisk  = "disk"  // new disk usage of a connected agent; Data is diskEvent
+	eventJob   = "job"   // a job changed state or made progress; Data is the job
+	eventFs    = "fs"    // files changed on an agent; Data is []pkg.FsEvent
+)
+
+const (
+	eventBuffer    = 256              // events queued per subscriber before it is dropped
+	eventHeartbeat = 30 * time.Second // SSE comment sent on idle streams so proxies keep them open
+)
+
+// Event is a change on bastion or an agent, fanned out to subscribers. AgentID is empty for
+// job events, which may involve two agents.
+type Event struct {
+	Type    string      `json:"type"`
+	AgentID string      `json:"agent_id,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+type agentEvent struct {
+	Connected       bool     `json:"connected"`
+	ProtocolVersion int      `json:"protocol_version,omitempty"`
+	AgentVersion    string   `json:"agent_version,omitempty"`
+	Capabilities    []string `json:"capabilities,omitempty"`
+}
+
+type diskEvent struct {
+	Free  int64 `json:"disk_free"`
+	Total int64 `json:"disk_total"`
+}
+
+// broker fans events out to subscribers. Publishing never blocks: a subscriber that falls
+// eventBuffer events behind has its channel closed and must resubscribe and resync.
+type broker struct {
+	mu   sync.Mutex
+	subs map[*subscription]struct{}
+}
+
+type subscription struct {
+	ch     chan Event
+	filter func(Event) bool
+}
+
+func newBroker() *broker {
+	return &broker{subs: make(map[*subscription]struct{})}
+}
+
+// subscribe returns a channel of the events for which filter returns true (all events if
+// filter is nil), and a function that ends the subscription.
+func (b *broker) subscribe(filter func(Event) bool) (<-chan Event, func()) {
+	sub := &subscription{ch: make(chan Event, eventBuffer), filter: filter}
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+	return sub.ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[sub]; ok {
+			delete(b.subs, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+func (b *broker) publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		if sub.filter != nil && !sub.filter(e) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			delete(b.subs, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// Events streams everything that happens on bastion as server-sent events: agents connecting
+// and disconnecting, disk usage, job progress and file changes. types limits the stream to a
+// comma-separated list of event types. Events only report changes: a client loads the current
+// state (GET /api/agents, /api/jobs) when the stream opens, including after a reconnect.
+// GET /api/events[?types=agent,disk,job,fs]
+func (s *Server) Events(w http.ResponseWriter, r *http.Request) {
+	types := make(map[string]bool)
+	for _, t := range strings.Split(r.URL.Query().Get("types"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types[t] = true
+		}
+	}
+	claims := ClaimsFromContext(r.Context())
+	acc, err := s.userAccess(r.Context(), claims, "")
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	events, cancel := s.hub.events.subscribe(func(e Event) bool { return len(types) == 0 || types[e.Type] })
+	defer cancel()
+	serveEvents(w, r, events, func(e Event) (Event, bool) { return visibleEvent(e, claims, acc) })
+}
+
+// visibleEvent returns the part of e the user may see: events of the agents granted to
+// them, their own jobs, and changes to the paths they may read. Grants are those loaded
+// when the stream opened.
+func visibleEvent(e Event, claims *SessionClaims, acc map[string]access) (Event, bool) {
+	if claims.siteAdmin() {
+		return e, true
+	}
+	if e.Type == eventJob {
+		j, ok := e.Data.(*job)
+		return e, ok && j.UserID == claims.UserID
+	}
+	a := accessTo(acc, claims, e.AgentID)
+	if !a.visible() {
+		return e, false
+	}
+	if changes, ok := e.Data.([]pkg.FsEvent); ok {
+		var shown []pkg.FsEvent
+		for _, c := range changes {
+			if c.Op == pkg.FsOverflow || a.readable(c.Path) {
+				shown = append(shown, c)
+			}
+		}
+		e.Data = shown
+		return e, len(shown) > 0
+	}
+	return e, true
+}
+
+// AgentFsEvents streams the agent's file changes as server-sent events ("event: fs", data is
+// an Event whose data is a list of pkg.FsEvent). The stream stays open across agent reconnects.
+// It ends if the client falls behind; an EventSource then reconnects on its own, and the
+// client should reload whatever it shows since changes may have been missed.
+// GET /api/agents/{id}/fs-events
+func (s *Server) AgentFsEvents(w http.ResponseWriter, r *http.Request) {
+	agentID := r.PathValue("id")
+	if agentID == "" {
+		writeJSONError(w, http.StatusBadRequest, "agent id required")
+		return
+	}
+	claims := ClaimsFromContext(r.Context())
+	acc, ok := s.authorize(w, r, agentID, permRead)
+	if !ok {
+		return
+	}
+	if ac := s.hub.Get(agentID); ac != nil && !ac.Supports(pkg.CapWatch) {
+		writeJSONError(w, http.StatusNotImplemented, "unsupported by agent: "+pkg.TypeFsEvent)
+		return
+	}
+	events, cancel := s.hub.events.subscribe(func(e Event) bool { return e.Type == eventFs && e.AgentID == agentID })
+	defer cancel()
+	serveEvents(w, r, events, func(e Event) (Event, bool) {
+		return visibleEvent(e, claims, map[string]access{agentID: acc})
+	})
+}
+
+// serveEvents writes events as a text/event-stream until the client goes away or the
+// subscription is dropped. view returns what the client may see of each event, if anything.
+func serveEvents(w http.ResponseWriter, r *http.Request, events <-chan Event, view func(Event) (Event, bool)) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if e, ok = view(e); !ok {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"blackbox/pkg"
+
+	"github.com/google/uuid"
+)
+
+// AgentExtract queues extraction of a zip, tar or tar.gz archive on the agent into a directory.
+// POST /api/agents/:id/extract {"path","dest","overwrite"}. Replies 202 with the job; when it
+// is done, its result lists the files written and any entries that were refused or failed.
+func (s *Server) AgentExtract(w http.ResponseWriter, r *http.Request) {
+	agentID := r.PathValue("id")
+	if agentID == "" {
+		writeJSONError(w, http.StatusBadRequest, "agent id required")
+		return
+	}
+	var req struct {
+		Path      string `json:"path"`
+		Dest      string `json:"dest"`
+		Overwrite bool   `json:"overwrite"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad request")
+		return
+	}
+	s.startJob(w, r, jobExtract, jobParams{Agent: agentID, Path: req.Path, ToPath: req.Dest, Overwrite: req.Overwrite})
+}
+
+// checkExtract validates an extract job before it is queued.
+func (s *Server) checkExtract(w http.ResponseWriter, r *http.Request, ac *AgentConn, p jobParams) bool {
+	if p.ToPath == "" {
+		writeJSONError(w, http.StatusBadRequest, "dest required")
+		return false
+	}
+	if p.ToAgent != "" && p.ToAgent != p.Agent {
+		writeJSONError(w, http.StatusBadRequest, "archives are extracted on the agent that holds them")
+		return false
+	}
+	if err := ac.require(pkg.TypeExtract); err != nil {
+		writeAgentError(w, err)
+		return false
+	}
+	meta, err := s.getMeta(r.Context(), ac, p.Path)
+	if err != nil {
+		writeAgentError(w, err)
+		return false
+	}
+	if meta.IsDir {
+		writeJSONError(w, http.StatusBadRequest, "is a directory")
+		return false
+	}
+	return true
+}
+
+// runExtract executes an extract job. The agent reports once at the end; the job's result is
+// the agent's report (files, bytes and failed entries).
+func (s *Server) runExtract(ctx context.Context, run *jobRun) error {
+	ac, err := s.jobAgent(run.Params.Agent)
+	if err != nil {
+		return err
+	}
+	run.set(func() { run.current = run.Params.Path })
+	reqID := uuid.New().String()
+	respData, err := ac.Request(ctx, reqID, pkg.ExtractRequest{
+		Type: pkg.TypeExtract, RequestID: reqID, Path: run.Params.Path, Dest: run.Params.ToPath, Overwrite: run.Params.Overwrite,
+	})
+	if err != nil {
+		return err
+	}
+	var resp pkg.ExtractResponse
+	if err := json.Unmarshal(respData, &resp); err != nil {
+		return err
+	}
+	run.set(func() {
+		run.filesTotal, run.filesDone = resp.Files+len(resp.Failed), resp.Files
+		run.bytesTotal = resp.Bytes
+	})
+	run.bytesDone.Store(resp.Bytes)
+	if resp.Failed == nil {
+		resp.Failed = []pkg.ExtractFailure{}
+	}
+	run.result, _ = json.Marshal(struct {
+		Files  int                  `json:"files"`
+		Bytes  int64                `json:"bytes"`
+		Failed []pkg.ExtractFailure `json:"failed"`
+	}{resp.Files, resp.Bytes, resp.Failed})
+	if resp.Error != "" {
+		return &AgentError{Msg: resp.Error}
+	}
+	return nil
+}
@@ -2,10 +2,18 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	pathpkg "path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"blackbox/pkg"
@@ -25,23 +33,45 @@ func (s *Server) AgentFiles(w http.ResponseWriter, r *http.Request) {
 	if path == "" {
 		path = "."
 	}
+	acc, ok := s.authorize(w, r, agentID, permRead)
+	if !ok {
+		return
+	}
+	listing := r.Method == http.MethodGet && r.URL.Query().Get("download") != "1"
+	level := permRead
+	switch r.Method {
+	case http.MethodPut:
+		level = permWrite
+	case http.MethodDelete:
+		level = permDelete
+	}
+	// Directories above a grant can be listed, showing only the way to it.
+	if listing && !acc.readable(path) || !listing && !acc.allows(level, path) {
+		writePermissionDenied(w, level, path)
+		return
+	}
 	ac := s.hub.Get(agentID)
 	if ac == nil {
+		if listing {
+			s.indexedListDir(w, r, agentID, path, acc)
+			return
+		}
 		writeJSONError(w, http.StatusServiceUnavailable, "agent not connected")
 		return
 	}
-	ctx, cancel := context.WithTimeout(r.Context(), proxyTimeout)
-	defer cancel()
-	if r.Method == http.MethodGet && r.URL.Query().Get("download") == "1" {
-		s.proxyReadFile(ctx, w, ac, path)
+	// Transfers are chunked streams bounded by streamIdleTimeout, not proxyTimeout.
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && r.URL.Query().Get("download") == "1" {
+		s.proxyReadFile(r.Context(), w, r, ac, path, writeAgentError)
 		return
 	}
-	if r.Method == http.MethodGet {
-		s.proxyListDir(ctx, w, ac, path)
+	if r.Method == http.MethodPut {
+		s.proxyWriteFile(r.Context(), w, r, ac, path)
 		return
 	}
-	if r.Method == http.MethodPut {
-		s.proxyWriteFile(ctx, w, r, ac, path)
+	ctx, cancel := context.WithTimeout(r.Context(), proxyTimeout)
+	defer cancel()
+	if r.Method == http.MethodGet {
+		s.proxyListDir(ctx, w, ac, path, acc)
 		return
 	}
 	if r.Method == http.MethodDelete {
@@ -61,27 +91,17 @@ func (s *Server) AgentMeta(w http.ResponseWriter, r *http.Request) {
 	if path == "" {
 		path = "."
 	}
+	if _, ok := s.authorize(w, r, agentID, permRead, path); !ok {
+		return
+	}
 	ac := s.hub.Get(agentID)
 	if ac == nil {
 		writeJSONError(w, http.StatusServiceUnavailable, "agent not connected")
 		return
 	}
-	ctx, cancel := context.WithTimeout(r.Context(), proxyTimeout)
-	defer cancel()
-	reqID := uuid.New().String()
-	req := pkg.GetMetaRequest{Type: pkg.TypeGetMeta, RequestID: reqID, Path: path}
-	respData, err := ac.Request(ctx, reqID, req)
+	resp, err := s.getMeta(r.Context(), ac, path)
 	if err != nil {
-		writeJSONError(w, http.StatusBadGateway, err.Error())
-		return
-	}
-	var resp pkg.GetMetaResponse
-	if json.Unmarshal(respData, &resp) != nil {
-		writeJSONError(w, http.StatusBadGateway, "invalid response")
-		return
-	}
-	if resp.Error != "" {
-		writeJSONError(w, http.StatusBadRequest, resp.Error)
+		writeAgentError(w, err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -92,12 +112,12 @@ func (s *Server) AgentMeta(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func (s *Server) proxyListDir(ctx context.Context, w http.ResponseWriter, ac *AgentConn, path string) {
+func (s *Server) proxyListDir(ctx context.Context, w http.ResponseWriter, ac *AgentConn, path string, acc access) {
 	reqID := uuid.New().String()
 	req := pkg.ListDirRequest{Type: pkg.TypeListDir, RequestID: reqID, Path: path}
 	respData, err := ac.Request(ctx, reqID, req)
 	if err != nil {
-		writeJSONError(w, http.StatusBadGateway, err.Error())
+		writeAgentError(w, err)
 		return
 	}
 	var resp pkg.ListDirResponse
@@ -110,15 +130,202 @@ func (s *Server) proxyListDir(ctx context.Context, w http.ResponseWriter, ac *Ag
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(resp.Entries)
+	_ = json.NewEncoder(w).Encode(acc.filterEntries(path, resp.Entries))
 }
 
-func (s *Server) proxyReadFile(ctx context.Context, w http.ResponseWriter, ac *AgentConn, path string) {
+// listDir returns the entries of a directory on the agent.
+func (s *Server) listDir(ctx context.Context, ac *AgentConn, path string) ([]pkg.FileEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, proxyTimeout)
+	defer cancel()
+	reqID := uuid.New().String()
+	respData, err := ac.Request(ctx, reqID, pkg.ListDirRequest{Type: pkg.TypeListDir, RequestID: reqID, Path: path})
+	if err != nil {
+		return nil, err
+	}
+	var resp pkg.ListDirResponse
+	if err := json.Unmarshal(respData, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, &AgentError{Msg: resp.Error}
+	}
+	return resp.Entries, nil
+}
+
+// proxyReadFile serves a download with Range, If-Range and conditional GET support. Errors
+// before the response starts are written with writeErr.
+// ETag and Last-Modified come from get_meta; only the requested bytes are streamed.
+// Directories (or any path with format=zip|tar.gz) are served as an archive.
+func (s *Server) proxyReadFile(ctx context.Context, w http.ResponseWriter, r *http.Request, ac *AgentConn, path string, writeErr func(http.ResponseWriter, error)) {
+	if !ac.Supports(pkg.CapStream) {
+		s.proxyReadFileLegacy(ctx, w, ac, path, writeErr)
+		return
+	}
+	meta, err := s.getMeta(ctx, ac, path)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	if format := r.URL.Query().Get("format"); format != "" || meta.IsDir {
+		if format == "" {
+			format = archiveZip
+		}
+		s.proxyArchive(ctx, w, r, ac, path, format, meta)
+		return
+	}
+	mtime, _ := time.Parse(time.RFC3339, meta.Mtime)
+	name := filepath.Base(filepath.FromSlash(path))
+	ctype := mime.TypeByExtension(filepath.Ext(name))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	w.Header().Set("ETag", fileETag(meta.Size, mtime))
+	f := &agentFile{ctx: ctx, ac: ac, path: path, size: meta.Size, ends: rangeEnds(r.Header.Get("Range"), meta.Size)}
+	defer f.Close()
+	http.ServeContent(w, r, name, mtime, f)
+}
+
+// getMeta fetches size, mtime and type of path, bounded by proxyTimeout.
+func (s *Server) getMeta(ctx context.Context, ac *AgentConn, path string) (*pkg.GetMetaResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, proxyTimeout)
+	defer cancel()
+	reqID := uuid.New().String()
+	respData, err := ac.Request(ctx, reqID, pkg.GetMetaRequest{Type: pkg.TypeGetMeta, RequestID: reqID, Path: path})
+	if err != nil {
+		return nil, err
+	}
+	var resp pkg.GetMetaResponse
+	if err := json.Unmarshal(respData, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, &AgentError{Msg: resp.Error}
+	}
+	return &resp, nil
+}
+
+// fileETag derives a validator from size and mtime; content hashes would need a full read.
+func fileETag(size int64, mtime time.Time) string {
+	return fmt.Sprintf(`"%x-%x"`, size, mtime.UnixNano())
+}
+
+// agentFile is an io.ReadSeeker over a file on the agent, for http.ServeContent.
+// Reads stream from the current position; a seek that moves the position drops the
+// open stream and the next read reopens it at the new offset. A stream opened at the start
+// of a requested range reads only to its end, so the agent does not send the rest of the file.
+type agentFile struct {
+	ctx  context.Context
+	ac   *AgentConn
+	path string
+	size int64
+	ends map[int64]int64 // requested ranges, start to end (exclusive)
+	pos  int64
+	rc   io.ReadCloser
+	end  int64 // where rc stops
+}
+
+func (f *agentFile) Read(p []byte) (int, error) {
+	if f.rc == nil {
+		if f.pos >= f.size {
+			return 0, io.EOF
+		}
+		f.end = f.size
+		if end, ok := f.ends[f.pos]; ok && end > f.pos && end < f.size {
+			f.end = end
+		}
+		rc, err := f.ac.OpenRead(f.ctx, f.path, f.pos, f.end-f.pos)
+		if err != nil {
+			return 0, err
+		}
+		f.rc = rc
+	}
+	n, err := f.rc.Read(p)
+	f.pos += int64(n)
+	if err == io.EOF && f.pos == f.end && f.end < f.size {
+		// End of a range, but the caller reads on (If-Range sent the whole file).
+		f.Close()
+		err = nil
+	}
+	return n, err
+}
+
+// rangeEnds parses a Range header ("bytes=0-99,200-") into the ranges it asks for, start to
+// end (exclusive). Anything it cannot parse is left out; ServeContent validates the header.
+func rangeEnds(h string, size int64) map[int64]int64 {
+	spec, ok := strings.CutPrefix(h, "bytes=")
+	if !ok {
+		return nil
+	}
+	ends := make(map[int64]int64)
+	for _, ra := range strings.Split(spec, ",") {
+		first, last, ok := strings.Cut(strings.TrimSpace(ra), "-")
+		if !ok {
+			continue
+		}
+		if first == "" {
+			// Suffix range: the last n bytes.
+			if n, err := strconv.ParseInt(last, 10, 64); err == nil && n > 0 {
+				ends[max(size-n, 0)] = size
+			}
+			continue
+		}
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil {
+			continue
+		}
+		end := size
+		if last != "" {
+			if l, err := strconv.ParseInt(last, 10, 64); err == nil && l+1 < size {
+				end = l + 1
+			}
+		}
+		ends[start] = end
+	}
+	return ends
+}
+
+func (f *agentFile) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = f.pos + offset
+	case io.SeekEnd:
+		pos = f.size + offset
+	default:
+		return 0, fmt.Errorf("seek: invalid whence")
+	}
+	if pos < 0 {
+		return 0, fmt.Errorf("seek: negative position")
+	}
+	if pos != f.pos {
+		f.Close()
+		f.pos = pos
+	}
+	return pos, nil
+}
+
+// Close aborts the open stream, if any.
+func (f *agentFile) Close() error {
+	if f.rc != nil {
+		f.rc.Close()
+		f.rc = nil
+	}
+	return nil
+}
+
+// proxyReadFileLegacy reads the whole file in one read_file message, for agents without stream support.
+func (s *Server) proxyReadFileLegacy(ctx context.Context, w http.ResponseWriter, ac *AgentConn, path string, writeErr func(http.ResponseWriter, error)) {
+	ctx, cancel := context.WithTimeout(ctx, proxyTimeout)
+	defer cancel()
 	reqID := uuid.New().String()
 	req := pkg.ReadFileRequest{Type: pkg.TypeReadFile, RequestID: reqID, Path: path}
 	respData, err := ac.Request(ctx, reqID, req)
 	if err != nil {
-		writeJSONError(w, http.StatusBadGateway, err.Error())
+		writeErr(w, err)
 		return
 	}
 	var resp pkg.ReadFileResponse
@@ -127,7 +334,7 @@ func (s *Server) proxyReadFile(ctx context.Context, w http.ResponseWriter, ac *A
 		return
 	}
 	if resp.Error != "" {
-		writeJSONError(w, http.StatusBadRequest, resp.Error)
+		writeErr(w, &AgentError{Msg: resp.Error})
 		return
 	}
 	data, err := base64.StdEncoding.DecodeString(resp.Data)
@@ -140,6 +347,54 @@ func (s *Server) proxyReadFile(ctx context.Context, w http.ResponseWriter, ac *A
 }
 
 func (s *Server) proxyWriteFile(ctx context.Context, w http.ResponseWriter, r *http.Request, ac *AgentConn, path string) {
+	if !ac.Supports(pkg.CapStream) {
+		s.proxyWriteFileLegacy(ctx, w, r, ac, path)
+		return
+	}
+	sum, err := requestSHA256(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := ac.WriteFrom(ctx, path, r.Body, sum); err != nil {
+		writeAgentError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requestSHA256 returns the expected SHA-256 (hex) of the request body from X-Content-SHA256 (hex)
+// or Digest: sha-256=<base64> (RFC 3230), or "" if the client sent neither.
+func requestSHA256(r *http.Request) (string, error) {
+	if v := strings.TrimSpace(r.Header.Get("X-Content-SHA256")); v != "" {
+		return validSHA256Hex(v)
+	}
+	for _, d := range strings.Split(r.Header.Get("Digest"), ",") {
+		alg, val, ok := strings.Cut(strings.TrimSpace(d), "=")
+		if !ok || !strings.EqualFold(alg, "sha-256") {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(val)
+		if err != nil || len(b) != sha256.Size {
+			return "", fmt.Errorf("invalid Digest sha-256")
+		}
+		return hex.EncodeToString(b), nil
+	}
+	return "", nil
+}
+
+func validSHA256Hex(s string) (string, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("invalid sha256 %q", s)
+	}
+	return strings.ToLower(s), nil
+}
+
+// proxyWriteFileLegacy buffers the body and sends one write_file message, for agents without stream support.
+func (s *Server) proxyWriteFileLegacy(ctx context.Context, w http.ResponseWriter, r *http.Request, ac *AgentConn, path string) {
+	ctx, cancel := context.WithTimeout(ctx, proxyTimeout)
+	defer cancel()
 	data, err := io.ReadAll(r.Body)
 	if err != nil {
 		writeJSONError(w, http.StatusBadRequest, "failed to read body")
@@ -154,7 +409,7 @@ func (s *Server) proxyWriteFile(ctx context.Context, w http.ResponseWriter, r *h
 	}
 	respData, err := ac.Request(ctx, reqID, req)
 	if err != nil {
-		writeJSONError(w, http.StatusBadGateway, err.Error())
+		writeAgentError(w, err)
 		return
 	}
 	var resp pkg.WriteFileResponse
@@ -174,7 +429,7 @@ func (s *Server) proxyDeleteFile(ctx context.Context, w http.ResponseWriter, ac
 	req := pkg.DeleteFileRequest{Type: pkg.TypeDeleteFile, RequestID: reqID, Path: path}
 	respData, err := ac.Request(ctx, reqID, req)
 	if err != nil {
-		writeJSONError(w, http.StatusBadGateway, err.Error())
+		writeAgentError(w, err)
 		return
 	}
 	var resp pkg.DeleteFileResponse
@@ -188,3 +443,147 @@ func (s *Server) proxyDeleteFile(ctx context.Context, w http.ResponseWriter, ac
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// AgentRename moves a file or directory. POST /api/agents/:id/rename {"from","to","overwrite"}
+func (s *Server) AgentRename(w http.ResponseWriter, r *http.Request) {
+	s.agentMoveOp(w, r, pkg.TypeRename)
+}
+
+// AgentCopy copies a file or directory tree on the agent. POST /api/agents/:id/copy {"from","to","overwrite"}
+func (s *Server) AgentCopy(w http.ResponseWriter, r *http.Request) {
+	s.agentMoveOp(w, r, pkg.TypeCopy)
+}
+
+func (s *Server) agentMoveOp(w http.ResponseWriter, r *http.Request, typ string) {
+	agentID := r.PathValue("id")
+	if agentID == "" {
+		writeJSONError(w, http.StatusBadRequest, "agent id required")
+		return
+	}
+	var body struct {
+		From      string `json:"from"`
+		To        string `json:"to"`
+		Overwrite bool   `json:"overwrite"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad request")
+		return
+	}
+	if body.From == "" || body.To == "" {
+		writeJSONError(w, http.StatusBadRequest, "from and to required")
+		return
+	}
+	// A rename removes the source; a copy only reads it.
+	fromLevel := permDelete
+	if typ == pkg.TypeCopy {
+		fromLevel = permRead
+	}
+	if _, ok := s.authorize(w, r, agentID, fromLevel, body.From); !ok {
+		return
+	}
+	if _, ok := s.authorize(w, r, agentID, permWrite, body.To); !ok {
+		return
+	}
+	ac := s.hub.Get(agentID)
+	if ac == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "agent not connected")
+		return
+	}
+	reqID := uuid.New().String()
+	var req interface{}
+	if typ == pkg.TypeCopy {
+		req = pkg.CopyRequest{Type: typ, RequestID: reqID, From: body.From, To: body.To, Overwrite: body.Overwrite}
+	} else {
+		req = pkg.RenameRequest{Type: typ, RequestID: reqID, From: body.From, To: body.To, Overwrite: body.Overwrite}
+	}
+	// Copies (and renames across filesystems) take as long as the data does; the agent
+	// stops when the client goes away.
+	s.proxyFileOp(r.Context(), w, ac, reqID, req)
+}
+
+// AgentMkdir creates a directory. POST /api/agents/:id/mkdir {"path"}
+func (s *Server) AgentMkdir(w http.ResponseWriter, r *http.Request) {
+	agentID := r.PathValue("id")
+	if agentID == "" {
+		writeJSONError(w, http.StatusBadRequest, "agent id required")
+		return
+	}
+	var body struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad request")
+		return
+	}
+	if body.Path == "" {
+		writeJSONError(w, http.StatusBadRequest, "path required")
+		return
+	}
+	if _, ok := s.authorize(w, r, agentID, permWrite, body.Path); !ok {
+		return
+	}
+	ac := s.hub.Get(agentID)
+	if ac == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "agent not connected")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), proxyTimeout)
+	defer cancel()
+	reqID := uuid.New().String()
+	s.proxyFileOp(ctx, w, ac, reqID, pkg.MkdirRequest{Type: pkg.TypeMkdir, RequestID: reqID, Path: body.Path})
+}
+
+// walkTree calls fn for every entry below the directory root on the agent, depth first and
+// parents before children. rel is the entry's path relative to root.
+func (s *Server) walkTree(ctx context.Context, ac *AgentConn, root string, fn func(rel string, e pkg.FileEntry) error) error {
+	return s.walkDir(ctx, ac, root, "", fn)
+}
+
+func (s *Server) walkDir(ctx context.Context, ac *AgentConn, root, dir string, fn func(rel string, e pkg.FileEntry) error) error {
+	entries, err := s.listDir(ctx, ac, pathpkg.Join(root, dir))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel := pathpkg.Join(dir, e.Name)
+		if err := fn(rel, e); err != nil {
+			return err
+		}
+		if e.IsDir {
+			if err := s.walkDir(ctx, ac, root, rel, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// proxyFileOp sends a request whose response carries only an error, and replies 204 on success.
+func (s *Server) proxyFileOp(ctx context.Context, w http.ResponseWriter, ac *AgentConn, reqID string, req interface{}) {
+	if err := agentOp(ctx, ac, reqID, req); err != nil {
+		writeAgentError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// agentOp sends a request whose response carries only an error (delete, rename, copy, mkdir).
+func agentOp(ctx context.Context, ac *AgentConn, reqID string, req interface{}) error {
+	respData, err := ac.Request(ctx, reqID, req)
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(respData, &resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return &AgentError{Msg: resp.Error}
+	}
+	return nil
+}
@@ -11,7 +11,11 @@ import (
 	"github.com/jackc/pgx/v5/pgconn"
 )
 
-const sessionExpiry = 24 * time.Hour
+const (
+	sessionExpiry        = 24 * time.Hour      // a session ends after this long unused
+	sessionMaxAge        = 30 * 24 * time.Hour // and at the latest this long after login
+	sessionTouchInterval = time.Minute         // last use is recorded at most this often
+)
 
 // writeJSONError sends a JSON error response {"error": "message"} with the given status code.
 func writeJSONError(w http.ResponseWriter, code int, message string) {
@@ -55,7 +59,8 @@ func (s *Server) Register(w http.ResponseWriter, r *http.Request) {
 		writeJSONError(w, http.StatusBadRequest, "username and password required")
 		return
 	}
-	_, err = CreateUser(ctx, s.pool, req.Username, req.Password)
+	// The first user administers the others.
+	_, err = CreateUser(ctx, s.pool, req.Username, req.Password, true)
 	if err != nil {
 		if isDuplicate(err) {
 			writeJSONError(w, http.StatusConflict, "username already exists")
@@ -96,19 +101,29 @@ func (s *Server) Login(w http.ResponseWriter, r *http.Request) {
 		writeJSONError(w, http.StatusUnauthorized, "invalid credentials")
 		return
 	}
-	token, err := IssueToken(user.ID, user.Username, s.cfg.JWTSecret, sessionExpiry)
+	if user.TOTPSecret != "" {
+		// Second step: POST /api/login/totp with the challenge and a code.
+		challenge, err := issueTOTPChallenge(user.ID, s.cfg.JWTSecret)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"totp_required": true, "challenge": challenge})
+		return
+	}
+	s.startSession(w, r, user)
+}
+
+// startSession logs user in: it records a session, sets the session cookie and returns the
+// token for API clients.
+func (s *Server) startSession(w http.ResponseWriter, r *http.Request, user *User) {
+	token, err := s.createSession(r, user)
 	if err != nil {
 		writeJSONError(w, http.StatusInternalServerError, "internal error")
 		return
 	}
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session",
-		Value:    token,
-		Path:     "/",
-		MaxAge:   int(sessionExpiry.Seconds()),
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-	})
+	setSessionCookie(w, token)
 	_ = json.NewEncoder(w).Encode(map[string]string{
 		"token":   token,
 		"user_id": user.ID,
@@ -131,11 +146,26 @@ func (s *Server) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			writeJSONError(w, http.StatusUnauthorized, "unauthorized")
 			return
 		}
-		claims, err := ValidateToken(token, s.cfg.JWTSecret)
-		if err != nil {
+		var claims *SessionClaims
+		var err error
+		if strings.HasPrefix(token, apiTokenPrefix) {
+			claims, err = s.useAPIToken(r, token)
+		} else {
+			claims, err = ValidateToken(token, s.cfg.JWTSecret)
+			if err != nil {
+				writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+			err = s.useSession(w, r, claims, token)
+		}
+		if errors.Is(err, errNoSession) {
 			writeJSONError(w, http.StatusUnauthorized, "unauthorized")
 			return
 		}
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
 		ctx := context.WithValue(r.Context(), ctxKeyClaims, claims)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	}
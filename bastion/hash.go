@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"blackbox/pkg"
+
+	"github.com/google/uuid"
+)
+
+// AgentHash hashes a file or directory tree on the agent.
+// GET /api/agents/:id/hash?path=...&algorithm=sha256|blake3|xxhash
+//
+// The response is newline-delimited JSON. For a directory, each file's {"path","size","digest"}
+// (or {"path","error"}) is streamed as the agent reads it; the last line is always the summary
+// {"algorithm","digest","files","bytes","failed"}. An error after streaming started is
+// reported as a final {"error"} line instead.
+func (s *Server) AgentHash(w http.ResponseWriter, r *http.Request) {
+	agentID := r.PathValue("id")
+	if agentID == "" {
+		writeJSONError(w, http.StatusBadRequest, "agent id required")
+		return
+	}
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		path = "."
+	}
+	alg := r.URL.Query().Get("algorithm")
+	switch alg {
+	case "":
+		alg = pkg.HashSHA256
+	case pkg.HashSHA256, pkg.HashBLAKE3, pkg.HashXXHash:
+	default:
+		writeJSONError(w, http.StatusBadRequest, "algorithm must be sha256, blake3 or xxhash")
+		return
+	}
+	if _, ok := s.authorize(w, r, agentID, permRead, path); !ok {
+		return
+	}
+	ac := s.hub.Get(agentID)
+	if ac == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "agent not connected")
+		return
+	}
+	enc := json.NewEncoder(w)
+	started := false
+	start := func() {
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+	}
+	// Hashing reads every byte, so it is bounded by the client, not proxyTimeout.
+	resp, err := ac.Hash(r.Context(), path, alg, func(entries []pkg.HashEntry) error {
+		start()
+		for _, e := range entries {
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		if !started {
+			writeAgentError(w, err)
+			return
+		}
+		_ = enc.Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	start()
+	_ = enc.Encode(map[string]interface{}{
+		"algorithm": resp.Algorithm,
+		"digest":    resp.Digest,
+		"files":     resp.Files,
+		"bytes":     resp.Bytes,
+		"failed":    resp.Failed,
+	})
+}
+
+// Hash asks the agent for the digest of the file or directory tree at path. For a directory,
+// fn is called with each batch of per-file entries as the agent sends them; an error from fn
+// cancels the request.
+func (ac *AgentConn) Hash(ctx context.Context, path, algorithm string, fn func([]pkg.HashEntry) error) (*pkg.HashResponse, error) {
+	if err := ac.require(pkg.TypeHash); err != nil {
+		return nil, err
+	}
+	reqID := uuid.New().String()
+	req := pkg.HashRequest{Type: pkg.TypeHash, RequestID: reqID, Path: path, Algorithm: algorithm}
+	data, err := ac.requestStream(ctx, reqID, req, func(data json.RawMessage) error {
+		var msg pkg.HashEntries
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return fmt.Errorf("invalid response")
+		}
+		return fn(msg.Entries)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var resp pkg.HashResponse
+	if json.Unmarshal(data, &resp) != nil {
+		return nil, fmt.Errorf("invalid response")
+	}
+	if resp.Error != "" {
+		return nil, &AgentError{Msg: resp.Error}
+	}
+	return &resp, nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"blackbox/pkg"
+
+	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	connectionHeartbeat = time.Minute         // open connections' last_seen is saved this often
+	connectionRetention = 90 * 24 * time.Hour // closed connections are deleted after this
+	uptimeWindow        = 7 * 24 * time.Hour  // window of the uptime in GET /api/agents
+	historyMaxDays      = 90                  // longest uptime window of the history endpoint
+	historyDefaultLimit = 100                 // connections returned by the history endpoint
+	historyMaxLimit     = 1000
+)
+
+// uptimeSeconds is a scalar subquery over agents a: how many seconds the agent was connected
+// since $1, or since it was created if that is later. Only the current connection is open.
+const uptimeSeconds = `(SELECT COALESCE(sum(EXTRACT(EPOCH FROM COALESCE(c.disconnected_at, now()) - GREATEST(c.connected_at, a.created_at, $1))), 0)::float8
+	FROM agent_connections c WHERE c.agent_id = a.id AND COALESCE(c.disconnected_at, now()) > GREATEST(a.created_at, $1))`
+
+// uptimePercent turns connected seconds since since into a percentage of the time elapsed.
+func uptimePercent(seconds float64, since time.Time) float64 {
+	window := time.Since(since).Seconds()
+	if window <= 0 {
+		return 0
+	}
+	return min(100, seconds/window*100)
+}
+
+// recordConnect opens a connection row for ac.
+func (s *Server) recordConnect(ctx context.Context, ac *AgentConn, r *http.Request, hello pkg.Auth) {
+	var id string
+	err := s.pool.QueryRow(ctx,
+		`INSERT INTO agent_connections (agent_id, remote_addr, agent_version, protocol_version) VALUES ($1, $2, $3, $4) RETURNING id::text`,
+		ac.AgentID, remoteIP(r), hello.AgentVersion, hello.ProtocolVersion).Scan(&id)
+	if err == nil {
+		_, err = s.pool.Exec(ctx, `UPDATE agents SET last_seen = now() WHERE id::text = $1`, ac.AgentID)
+	}
+	if err != nil {
+		log.Printf("agent ws: record connect for %s: %v", ac.AgentID, err)
+		return
+	}
+	ac.mu.Lock()
+	ac.connID = id
+	ac.mu.Unlock()
+}
+
+// recordDisconnect closes ac's connection row. err is what ended readLoop.
+func (s *Server) recordDisconnect(ac *AgentConn, err error) {
+	ac.mu.Lock()
+	id, reason := ac.connID, ac.closeReason
+	ac.mu.Unlock()
+	if id == "" {
+		return
+	}
+	if reason == "" {
+		reason = disconnectReason(err)
+	}
+	lastSeen, _ := ac.LastSeen()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	b := &pgx.Batch{}
+	b.Queue(`UPDATE agent_connections SET disconnected_at = now(), last_seen = $2, reason = $3 WHERE id::text = $1`, id, lastSeen, reason)
+	b.Queue(`UPDATE agents SET last_seen = $2 WHERE id::text = $1`, ac.AgentID, lastSeen)
+	if err := s.pool.SendBatch(ctx, b).Close(); err != nil {
+		log.Printf("agent ws: record disconnect for %s: %v", ac.AgentID, err)
+	}
+}
+
+// disconnectReason describes the read error that ended an agent connection.
+func disconnectReason(err error) string {
+	var closeErr *websocket.CloseError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &closeErr):
+		if closeErr.Code == websocket.CloseNormalClosure || closeErr.Code == websocket.CloseGoingAway {
+			return "closed by agent"
+		}
+		return fmt.Sprintf("closed by agent: %d %s", closeErr.Code, closeErr.Text)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "keepalive timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "connection lost"
+	case err != nil:
+		return err.Error()
+	}
+	return ""
+}
+
+// closeStaleConnections closes the rows left open by a previous bastion process at their
+// last heartbeat. Call before accepting agents.
+func (s *Server) closeStaleConnections(ctx context.Context) {
+	_, err := s.pool.Exec(ctx,
+		`UPDATE agent_connections SET disconnected_at = last_seen, reason = 'server restarted' WHERE disconnected_at IS NULL`)
+	if err != nil {
+		log.Printf("connections: close stale: %v", err)
+	}
+}
+
+// runConnectionLog saves the last-seen time of connected agents every connectionHeartbeat
+// and prunes old history. Run in goroutine.
+func (s *Server) runConnectionLog(ctx context.Context) {
+	t := time.NewTicker(connectionHeartbeat)
+	defer t.Stop()
+	lastPrune := time.Time{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		b := &pgx.Batch{}
+		for _, ac := range s.hub.List() {
+			ac.mu.Lock()
+			id := ac.connID
+			ac.mu.Unlock()
+			if id == "" {
+				continue
+			}
+			lastSeen, _ := ac.LastSeen()
+			b.Queue(`UPDATE agent_connections SET last_seen = $2 WHERE id::text = $1`, id, lastSeen)
+			b.Queue(`UPDATE agents SET last_seen = $2 WHERE id::text = $1`, ac.AgentID, lastSeen)
+		}
+		if time.Since(lastPrune) >= time.Hour {
+			b.Queue(`DELETE FROM agent_connections WHERE disconnected_at < $1`, time.Now().Add(-connectionRetention))
+			lastPrune = time.Now()
+		}
+		if err := s.pool.SendBatch(ctx, b).Close(); err != nil && ctx.Err() == nil {
+			log.Printf("connections: %v", err)
+		}
+	}
+}
+
+// agentConnection is a row of the agent_connections table.
+type agentConnection struct {
+	ConnectedAt     time.Time  `json:"connected_at"`
+	DisconnectedAt  *time.Time `json:"disconnected_at"` // nil while connected
+	LastSeen        time.Time  `json:"last_seen"`
+	RemoteAddr      string     `json:"remote_addr"`
+	AgentVersion    string     `json:"agent_version,omitempty"`
+	ProtocolVersion int        `json:"protocol_version"`
+	Reason          string     `json:"reason,omitempty"` // why the connection ended
+}
+
+// AgentHistory returns the agent's recent connections, newest first, with its uptime over
+// the last days days (default 7). GET /api/agents/:id/history?days=7&limit=100
+func (s *Server) AgentHistory(w http.ResponseWriter, r *http.Request) {
+	agentID := r.PathValue("id")
+	if _, ok := s.authorize(w, r, agentID, permRead); !ok {
+		return
+	}
+	q := r.URL.Query()
+	days := int(uptimeWindow / (24 * time.Hour))
+	if v := q.Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > historyMaxDays {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("days must be 1-%d", historyMaxDays))
+			return
+		}
+		days = n
+	}
+	limit := historyDefaultLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > historyMaxLimit {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("limit must be 1-%d", historyMaxLimit))
+			return
+		}
+		limit = n
+	}
+	var lastSeen *time.Time
+	var upSeconds float64
+	var since time.Time
+	err := s.pool.QueryRow(r.Context(),
+		`SELECT a.last_seen, `+uptimeSeconds+`, GREATEST(a.created_at, $1) FROM agents a WHERE a.id::text = $2`,
+		time.Now().AddDate(0, 0, -days), agentID).Scan(&lastSeen, &upSeconds, &since)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if ac := s.hub.Get(agentID); ac != nil {
+		seen, _ := ac.LastSeen()
+		lastSeen = &seen
+	}
+	rows, err := s.pool.Query(r.Context(),
+		`SELECT connected_at, disconnected_at, last_seen, remote_addr, agent_version, protocol_version, reason
+		 FROM agent_connections WHERE agent_id::text = $1 ORDER BY connected_at DESC LIMIT $2`, agentID, limit)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	defer rows.Close()
+	list := []agentConnection{}
+	for rows.Next() {
+		var c agentConnection
+		if err := rows.Scan(&c.ConnectedAt, &c.DisconnectedAt, &c.LastSeen, &c.RemoteAddr, &c.AgentVersion, &c.ProtocolVersion, &c.Reason); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		list = append(list, c)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"last_seen":    lastSeen,
+		"uptime":       uptimePercent(upSeconds, since),
+		"uptime_since": since,
+		"connections":  list,
+	})
+}
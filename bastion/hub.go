@@ -3,10 +3,15 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
+
+	"blackbox/pkg"
 
 	"github.com/gorilla/websocket"
 )
@@ -31,41 +36,89 @@ func wsCheckOrigin(allowed string) func(*http.Request) bool {
 type Hub struct {
 	mu     sync.RWMutex
 	agents map[string]*AgentConn
+	events *broker
 }
 
 // AgentConn is a single agent WebSocket with request/response pairing.
 type AgentConn struct {
 	AgentID string
-	conn   *websocket.Conn
-	mu     sync.Mutex
-	pending map[string]chan json.RawMessage
-	done   chan struct{}
+	// From the auth handshake; fixed for the life of the connection.
+	ProtocolVersion int
+	AgentVersion    string
+	caps            map[string]bool
+	conn            *websocket.Conn
+	writeMu         sync.Mutex // gorilla/websocket allows one concurrent writer
+	mu              sync.Mutex
+	pending         map[string]chan json.RawMessage
+	streams         map[string]*agentStream
+	disk            *diskEvent // last known disk usage, kept current by pollDisk
+	lastSeen        time.Time  // last message, ping or pong from the agent
+	rtt             time.Duration
+	connID          string // agent_connections row of this connection
+	closeReason     string // why bastion closed the connection, if it did
+	done            chan struct{}
+	closeOnce       sync.Once
 }
 
 func NewHub() *Hub {
-	return &Hub{agents: make(map[string]*AgentConn)}
+	return &Hub{agents: make(map[string]*AgentConn), events: newBroker()}
 }
 
-func (h *Hub) Register(agentID string, conn *websocket.Conn) *AgentConn {
+// Register adds an authenticated agent connection, replacing any previous one. hello is the agent's auth message.
+func (h *Hub) Register(agentID string, conn *websocket.Conn, hello pkg.Auth) *AgentConn {
+	caps := make(map[string]bool, len(hello.Capabilities))
+	for _, c := range hello.Capabilities {
+		caps[c] = true
+	}
 	ac := &AgentConn{
-		AgentID: agentID,
-		conn:    conn,
-		pending: make(map[string]chan json.RawMessage),
-		done:    make(chan struct{}),
+		AgentID:         agentID,
+		ProtocolVersion: hello.ProtocolVersion,
+		AgentVersion:    hello.AgentVersion,
+		caps:            caps,
+		conn:            conn,
+		pending:         make(map[string]chan json.RawMessage),
+		streams:         make(map[string]*agentStream),
+		done:            make(chan struct{}),
 	}
 	h.mu.Lock()
 	if old, ok := h.agents[agentID]; ok {
+		old.mu.Lock()
+		old.closeReason = "replaced by a new connection"
+		old.mu.Unlock()
 		old.close()
 	}
 	h.agents[agentID] = ac
 	h.mu.Unlock()
+	h.events.publish(Event{Type: eventAgent, AgentID: agentID, Data: agentEvent{
+		Connected:       true,
+		ProtocolVersion: hello.ProtocolVersion,
+		AgentVersion:    hello.AgentVersion,
+		Capabilities:    hello.Capabilities,
+	}})
 	return ac
 }
 
 func (h *Hub) Unregister(agentID string) {
 	h.mu.Lock()
+	_, ok := h.agents[agentID]
 	delete(h.agents, agentID)
 	h.mu.Unlock()
+	if ok {
+		h.events.publish(Event{Type: eventAgent, AgentID: agentID, Data: agentEvent{}})
+	}
+}
+
+// remove unregisters ac when its connection ends, unless the agent has already reconnected.
+func (h *Hub) remove(ac *AgentConn) {
+	h.mu.Lock()
+	ok := h.agents[ac.AgentID] == ac
+	if ok {
+		delete(h.agents, ac.AgentID)
+	}
+	h.mu.Unlock()
+	if ok {
+		h.events.publish(Event{Type: eventAgent, AgentID: ac.AgentID, Data: agentEvent{}})
+	}
 }
 
 func (h *Hub) Get(agentID string) *AgentConn {
@@ -74,22 +127,88 @@ func (h *Hub) Get(agentID string) *AgentConn {
 	return h.agents[agentID]
 }
 
+// List returns the connected agents.
+func (h *Hub) List() []*AgentConn {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	list := make([]*AgentConn, 0, len(h.agents))
+	for _, ac := range h.agents {
+		list = append(list, ac)
+	}
+	return list
+}
+
 func (h *Hub) Connected(agentID string) bool {
 	return h.Get(agentID) != nil
 }
 
+// close fails the pending requests and closes the connection. It is safe to call more than
+// once: Register closes a replaced connection, and its readLoop closes it again on the way out.
 func (ac *AgentConn) close() {
-	ac.mu.Lock()
-	for _, ch := range ac.pending {
-		select {
-		case ch <- nil:
-		default:
+	ac.closeOnce.Do(func() {
+		ac.mu.Lock()
+		for _, ch := range ac.pending {
+			select {
+			case ch <- nil:
+			default:
+			}
 		}
+		ac.pending = nil
+		ac.streams = nil
+		ac.mu.Unlock()
+		ac.conn.Close()
+		close(ac.done)
+	})
+}
+
+// Disk returns the agent's last known free and total bytes; ok is false until the first
+// get_disk has answered.
+func (ac *AgentConn) Disk() (free, total int64, ok bool) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ac.disk == nil {
+		return 0, 0, false
 	}
-	ac.pending = nil
-	ac.mu.Unlock()
-	ac.conn.Close()
-	close(ac.done)
+	return ac.disk.Free, ac.disk.Total, true
+}
+
+// setDisk records disk usage and reports whether it changed.
+func (ac *AgentConn) setDisk(d diskEvent) bool {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ac.disk != nil && *ac.disk == d {
+		return false
+	}
+	ac.disk = &d
+	return true
+}
+
+// requiredCaps maps message types added after protocol 0 to the capability an agent must advertise.
+// Requests for other capabilities fail fast with unsupportedError instead of waiting for a timeout.
+var requiredCaps = map[string]string{
+	pkg.TypeStreamOpen:   pkg.CapStream,
+	pkg.TypeUploadStat:   pkg.CapUpload,
+	pkg.TypeUploadCommit: pkg.CapUpload,
+	pkg.TypeUploadAbort:  pkg.CapUpload,
+	pkg.TypeRename:       pkg.CapFileOps,
+	pkg.TypeCopy:         pkg.CapFileOps,
+	pkg.TypeMkdir:        pkg.CapFileOps,
+	pkg.TypeExtract:      pkg.CapExtract,
+	pkg.TypeHash:         pkg.CapHash,
+	pkg.TypeSearch:       pkg.CapSearch,
+}
+
+// Supports reports whether the agent advertised capability c.
+func (ac *AgentConn) Supports(c string) bool {
+	return ac.caps[c]
+}
+
+// require returns unsupportedError if the agent cannot handle messages of type typ.
+func (ac *AgentConn) require(typ string) error {
+	if c, ok := requiredCaps[typ]; ok && !ac.Supports(c) {
+		return &unsupportedError{What: typ}
+	}
+	return nil
 }
 
 // Request sends a JSON message to the agent and waits for the response (by request_id).
@@ -101,6 +220,15 @@ func (ac *AgentConn) Request(ctx context.Context, requestID string, req interfac
 	if err != nil {
 		return nil, err
 	}
+	var envelope struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	if err := ac.require(envelope.Type); err != nil {
+		return nil, err
+	}
 	ch := make(chan json.RawMessage, 1)
 	ac.mu.Lock()
 	if ac.pending == nil {
@@ -114,7 +242,7 @@ func (ac *AgentConn) Request(ctx context.Context, requestID string, req interfac
 		delete(ac.pending, requestID)
 		ac.mu.Unlock()
 	}()
-	if err := ac.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+	if err := ac.write(data); err != nil {
 		return nil, err
 	}
 	select {
@@ -122,34 +250,133 @@ func (ac *AgentConn) Request(ctx context.Context, requestID string, req interfac
 		if resp == nil {
 			return nil, errConnClosed
 		}
+		var errResp pkg.ErrorResponse
+		if json.Unmarshal(resp, &errResp) == nil && errResp.Type == pkg.TypeError {
+			if errResp.Code == pkg.ErrCodeUnsupported {
+				return nil, &unsupportedError{What: envelope.Type}
+			}
+			if errResp.Code == pkg.ErrCodeBusy {
+				return nil, errAgentBusy
+			}
+			return nil, &AgentError{Msg: errResp.Error}
+		}
 		return resp, nil
 	case <-ctx.Done():
+		ac.cancel(requestID)
 		return nil, ctx.Err()
 	case <-ac.done:
 		return nil, errConnClosed
 	}
 }
 
+// cancel tells the agent to abort work for requestID. Best effort; older agents keep going.
+func (ac *AgentConn) cancel(requestID string) {
+	if !ac.Supports(pkg.CapCancel) {
+		return
+	}
+	if err := ac.send(pkg.Cancel{Type: pkg.TypeCancel, RequestID: requestID}); err != nil {
+		log.Printf("agent %s: send cancel: %v", ac.AgentID, err)
+	}
+}
+
+// write sends one text message. Safe for concurrent use.
+func (ac *AgentConn) write(data []byte) error {
+	ac.writeMu.Lock()
+	defer ac.writeMu.Unlock()
+	return ac.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// writeBinary sends one binary frame. Safe for concurrent use.
+func (ac *AgentConn) writeBinary(frame []byte) error {
+	ac.writeMu.Lock()
+	defer ac.writeMu.Unlock()
+	return ac.conn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+// send marshals v and sends it to the agent without waiting for a response.
+func (ac *AgentConn) send(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ac.write(data)
+}
+
 var errNoRequestID = fmt.Errorf("request_id required")
 var errConnClosed = fmt.Errorf("connection closed")
+var errAgentBusy = fmt.Errorf("agent busy")
+
+// AgentError is a failure reported by the agent (bad path, missing file, ...) as opposed to a transport error.
+type AgentError struct {
+	Msg string
+}
+
+func (e *AgentError) Error() string { return e.Msg }
+
+// unsupportedError is returned for requests the connected agent did not advertise support for.
+type unsupportedError struct {
+	What string
+}
+
+func (e *unsupportedError) Error() string { return "unsupported by agent: " + e.What }
+
+// writeAgentError maps an error from an agent request or stream to an HTTP error response.
+func writeAgentError(w http.ResponseWriter, err error) {
+	var agentErr *AgentError
+	var unsupported *unsupportedError
+	switch {
+	case errors.As(err, &agentErr):
+		writeJSONError(w, http.StatusBadRequest, agentErr.Msg)
+	case errors.As(err, &unsupported):
+		writeJSONError(w, http.StatusNotImplemented, unsupported.Error())
+	case errors.Is(err, errReadSource):
+		writeJSONError(w, http.StatusBadRequest, "failed to read body")
+	case errors.Is(err, errAgentBusy):
+		w.Header().Set("Retry-After", "1")
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeJSONError(w, http.StatusBadGateway, err.Error())
+	}
+}
 
-// readLoop reads responses and dispatches to pending channels. Run in goroutine.
-func (ac *AgentConn) readLoop(hub *Hub) {
+// readLoop reads responses and dispatches to pending channels until the connection fails,
+// and returns the read error that ended it.
+func (ac *AgentConn) readLoop(hub *Hub) error {
 	defer func() {
-		hub.Unregister(ac.AgentID)
+		hub.remove(ac)
 		ac.close()
 	}()
 	for {
-		_, data, err := ac.conn.ReadMessage()
+		msgType, data, err := ac.conn.ReadMessage()
 		if err != nil {
-			return
+			return err
+		}
+		ac.touch()
+		if msgType == websocket.BinaryMessage {
+			ac.routeFrame(data)
+			continue
 		}
 		var envelope struct {
+			Type      string `json:"type"`
 			RequestID string `json:"request_id"`
 		}
 		if json.Unmarshal(data, &envelope) != nil {
 			continue
 		}
+		switch envelope.Type {
+		case pkg.TypeStreamAck, pkg.TypeStreamClose:
+			ac.routeStream(envelope.Type, envelope.RequestID, data)
+			continue
+		case pkg.TypeHashEntries, pkg.TypeSearchMatches:
+			ac.deliver(envelope.RequestID, streamMsg{Type: envelope.Type, Data: data})
+			continue
+		case pkg.TypeFsEvent:
+			var msg pkg.FsEvents
+			if json.Unmarshal(data, &msg) == nil && len(msg.Events) > 0 {
+				hub.events.publish(Event{Type: eventFs, AgentID: ac.AgentID, Data: msg.Events})
+			}
+			continue
+		}
 		ac.mu.Lock()
 		ch := ac.pending[envelope.RequestID]
 		ac.mu.Unlock()
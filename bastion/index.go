@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	pathpkg "path"
+	"time"
+
+	"blackbox/pkg"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	indexInterval = 15 * time.Minute // a connected agent is re-indexed this long after its last pass
+	indexPoll     = time.Minute
+	indexSettle   = 2 * time.Second // fs events are collected this long before directories are re-listed
+)
+
+// runIndexer keeps the files table in step with connected agents, one agent at a time so the
+// walk never competes with itself. Run in goroutine.
+func (s *Server) runIndexer(ctx context.Context) {
+	t := time.NewTicker(indexPoll)
+	defer t.Stop()
+	for {
+		s.indexAgents(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// indexAgents indexes each connected agent whose last pass is older than indexInterval.
+func (s *Server) indexAgents(ctx context.Context) {
+	rows, err := s.pool.Query(ctx,
+		`SELECT id::text FROM agents WHERE indexed_at IS NULL OR indexed_at < $1 ORDER BY indexed_at NULLS FIRST`,
+		time.Now().Add(-indexInterval))
+	if err != nil {
+		log.Printf("indexer: %v", err)
+		return
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		log.Printf("indexer: %v", err)
+		return
+	}
+	for _, id := range ids {
+		ac := s.hub.Get(id)
+		if ac == nil {
+			continue
+		}
+		start := time.Now()
+		if err := s.indexAgent(ctx, ac); err != nil {
+			if ctx.Err() == nil && !isAgentOffline(err) {
+				log.Printf("indexer: agent %s: %v", id, err)
+			}
+			continue
+		}
+		log.Printf("indexer: agent %s indexed in %s", id, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// indexAgent walks the agent's tree with list_dir and brings its rows up to date. Only new,
+// changed (type, size or mtime) and vanished entries are written, so a pass over an unchanged
+// tree costs one SELECT per directory. Directories that cannot be listed keep their old rows.
+func (s *Server) indexAgent(ctx context.Context, ac *AgentConn) error {
+	start := time.Now()
+	dirs := []string{"."}
+	for len(dirs) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		dir := dirs[len(dirs)-1]
+		dirs = dirs[:len(dirs)-1]
+		entries, err := s.listDir(ctx, ac, dir)
+		var agentErr *AgentError
+		if errors.As(err, &agentErr) && dir != "." {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		subdirs, err := s.indexDir(ctx, ac.AgentID, dir, entries)
+		if err != nil {
+			return err
+		}
+		dirs = append(dirs, subdirs...)
+	}
+	_, err := s.pool.Exec(ctx, `UPDATE agents SET indexed_at = $2 WHERE id::text = $1`, ac.AgentID, start)
+	return err
+}
+
+// indexDir reconciles the rows whose parent is dir with a fresh listing and returns the
+// paths of its subdirectories.
+func (s *Server) indexDir(ctx context.Context, agentID, dir string, entries []pkg.FileEntry) ([]string, error) {
+	type row struct {
+		isDir bool
+		size  int64
+		mtime *time.Time
+	}
+	rows, err := s.pool.Query(ctx, `SELECT name, is_dir, size, mtime FROM files WHERE agent_id = $1 AND parent = $2`, agentID, dir)
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]row)
+	for rows.Next() {
+		var name string
+		var r row
+		if err := rows.Scan(&name, &r.isDir, &r.size, &r.mtime); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		known[name] = r
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var subdirs []string
+	b := &pgx.Batch{}
+	for _, e := range entries {
+		p := pathpkg.Join(dir, e.Name)
+		if e.IsDir {
+			subdirs = append(subdirs, p)
+		}
+		var mtime *time.Time
+		if t, err := time.Parse(time.RFC3339, e.Mtime); err == nil {
+			mtime = &t
+		}
+		old, ok := known[e.Name]
+		delete(known, e.Name)
+		if ok && old.isDir == e.IsDir && old.size == e.Size && sameTime(old.mtime, mtime) {
+			continue
+		}
+		if ok && old.isDir && !e.IsDir {
+			queueDeleteTree(b, agentID, p)
+		}
+		b.Queue(`INSERT INTO files (agent_id, path, parent, name, is_dir, size, mtime) VALUES ($1, $2, $3, $4, $5, $6, $7)
+			ON CONFLICT (agent_id, path) DO UPDATE SET is_dir = EXCLUDED.is_dir, size = EXCLUDED.size, mtime = EXCLUDED.mtime`,
+			agentID, p, dir, e.Name, e.IsDir, e.Size, mtime)
+	}
+	for name := range known {
+		queueDeleteTree(b, agentID, pathpkg.Join(dir, name))
+	}
+	if b.Len() > 0 {
+		if err := s.pool.SendBatch(ctx, b).Close(); err != nil {
+			return nil, err
+		}
+	}
+	return subdirs, nil
+}
+
+// runIndexUpdates applies agents' fs events to the index between full passes: each
+// directory in which something changed is re-listed and reconciled with indexDir. Agents
+// that reported an overflow, and all agents if this subscriber fell behind, are made due
+// for a full pass instead. Run in goroutine.
+func (s *Server) runIndexUpdates(ctx context.Context) {
+	t := time.NewTicker(indexSettle)
+	defer t.Stop()
+	for ctx.Err() == nil {
+		events, cancel := s.hub.events.subscribe(func(e Event) bool { return e.Type == eventFs })
+		dirty := make(map[string]map[string]bool) // agent ID -> directories to re-list
+		for dropped := false; !dropped; {
+			select {
+			case <-ctx.Done():
+				cancel()
+				return
+			case e, ok := <-events:
+				if !ok {
+					dropped = true
+					s.expireIndex(ctx, "")
+					break
+				}
+				fes, _ := e.Data.([]pkg.FsEvent)
+				for _, fe := range fes {
+					if fe.Op == pkg.FsOverflow {
+						s.expireIndex(ctx, e.AgentID)
+						continue
+					}
+					if dirty[e.AgentID] == nil {
+						dirty[e.AgentID] = make(map[string]bool)
+					}
+					dirty[e.AgentID][indexPath(pathpkg.Dir(fe.Path))] = true
+				}
+			case <-t.C:
+				for agentID, dirs := range dirty {
+					s.reindexDirs(ctx, agentID, dirs)
+				}
+				clear(dirty)
+			}
+		}
+		cancel()
+	}
+}
+
+// reindexDirs re-lists dirs on an indexed, connected agent. Directories that no longer exist
+// are skipped; their parent's re-listing removes them.
+func (s *Server) reindexDirs(ctx context.Context, agentID string, dirs map[string]bool) {
+	ac := s.hub.Get(agentID)
+	if ac == nil {
+		return
+	}
+	var indexedAt *time.Time
+	if err := s.pool.QueryRow(ctx, `SELECT indexed_at FROM agents WHERE id::text = $1`, agentID).Scan(&indexedAt); err != nil || indexedAt == nil {
+		return // the first full pass picks everything up
+	}
+	for dir := range dirs {
+		entries, err := s.listDir(ctx, ac, dir)
+		var agentErr *AgentError
+		if errors.As(err, &agentErr) {
+			continue
+		}
+		if err == nil {
+			_, err = s.indexDir(ctx, agentID, dir, entries)
+		}
+		if err != nil {
+			if ctx.Err() == nil && !isAgentOffline(err) {
+				log.Printf("indexer: agent %s: %s: %v", agentID, dir, err)
+			}
+			return
+		}
+	}
+}
+
+// expireIndex makes the agent (every agent if agentID is "") due for a full pass on the next
+// poll, keeping its indexed_at set so offline listings and searches still use the index.
+func (s *Server) expireIndex(ctx context.Context, agentID string) {
+	_, err := s.pool.Exec(ctx, `UPDATE agents SET indexed_at = $2 WHERE ($1 = '' OR id::text = $1) AND indexed_at > $2`,
+		agentID, time.Now().Add(-indexInterval))
+	if err != nil && ctx.Err() == nil {
+		log.Printf("indexer: %v", err)
+	}
+}
+
+// queueDeleteTree removes the row for p and every row below it.
+func queueDeleteTree(b *pgx.Batch, agentID, p string) {
+	b.Queue(`DELETE FROM files WHERE agent_id = $1 AND (path = $2 OR left(path, char_length($2) + 1) = $2 || '/')`, agentID, p)
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// indexedListDir serves the last-known listing of dir for an agent that is not connected.
+// The X-Indexed-At header carries when the index was taken; without an index the agent
+// is simply not connected (503).
+func (s *Server) indexedListDir(w http.ResponseWriter, r *http.Request, agentID, dir string, acc access) {
+	var indexedAt *time.Time
+	err := s.pool.QueryRow(r.Context(), `SELECT indexed_at FROM agents WHERE id::text = $1`, agentID).Scan(&indexedAt)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if indexedAt == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "agent not connected")
+		return
+	}
+	dir = indexPath(dir)
+	rows, err := s.pool.Query(r.Context(),
+		`SELECT name, is_dir, size, mtime FROM files WHERE agent_id = $1 AND parent = $2 ORDER BY name`, agentID, dir)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	defer rows.Close()
+	entries := []pkg.FileEntry{}
+	for rows.Next() {
+		var e pkg.FileEntry
+		var mtime *time.Time
+		if err := rows.Scan(&e.Name, &e.IsDir, &e.Size, &mtime); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		if mtime != nil {
+			e.Mtime = mtime.Format(time.RFC3339)
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if len(entries) == 0 && dir != "." {
+		var n int
+		_ = s.pool.QueryRow(r.Context(), `SELECT count(*) FROM files WHERE agent_id = $1 AND path = $2 AND is_dir`, agentID, dir).Scan(&n)
+		if n == 0 {
+			writeJSONError(w, http.StatusNotFound, "not in index")
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Indexed-At", indexedAt.UTC().Format(time.RFC3339))
+	_ = json.NewEncoder(w).Encode(acc.filterEntries(dir, entries))
+}
+
+// indexPath normalizes a request path to the form stored in the files table.
+func indexPath(p string) string {
+	p = pathpkg.Clean("/" + p)
+	if p == "/" {
+		return "."
+	}
+	return p[1:]
+}
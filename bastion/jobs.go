@@ -0,0 +1,593 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"blackbox/pkg"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Job states. A job that loses an agent is paused and queued again when the agent reconnects.
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobPaused  = "paused"
+	jobFailed  = "failed"
+	jobDone    = "done"
+)
+
+// Job kinds.
+const (
+	jobCopy    = "copy"    // copy a file or tree, possibly to another agent
+	jobMove    = "move"    // copy, then delete the source
+	jobDelete  = "delete"  // delete a file or tree
+	jobExtract = "extract" // unpack an archive on the agent into to_path
+)
+
+const (
+	jobWorkers     = 4
+	jobMaxAttempts = 10 // runs per job before a lost agent fails it instead of pausing it
+	jobPoll        = 30 * time.Second
+	jobFlush       = time.Second         // progress is written to the jobs table this often
+	jobRetention   = 30 * 24 * time.Hour // finished jobs are deleted after this
+)
+
+var errJobCancelled = errors.New("cancelled")
+var errAgentOffline = errors.New("agent not connected")
+
+// jobParams are the kind-specific inputs of a job, stored as JSON. Agent and Path are the
+// source (or the target of a delete); ToAgent and ToPath the destination of a copy or move.
+// An extract unpacks the archive at Path into the directory ToPath on the same agent.
+type jobParams struct {
+	Agent     string `json:"agent"`
+	Path      string `json:"path"`
+	ToAgent   string `json:"to_agent,omitempty"`
+	ToPath    string `json:"to_path,omitempty"`
+	Overwrite bool   `json:"overwrite,omitempty"`
+}
+
+func (p jobParams) agentIDs() []string {
+	if p.ToAgent != "" && p.ToAgent != p.Agent {
+		return []string{p.Agent, p.ToAgent}
+	}
+	return []string{p.Agent}
+}
+
+// job is a row of the jobs table.
+type job struct {
+	ID         string          `json:"id"`
+	Kind       string          `json:"kind"`
+	Params     jobParams       `json:"params"`
+	State      string          `json:"state"`
+	Error      string          `json:"error,omitempty"`
+	Attempts   int             `json:"attempts"`
+	FilesTotal int             `json:"files_total"`
+	FilesDone  int             `json:"files_done"`
+	BytesTotal int64           `json:"bytes_total"`
+	BytesDone  int64           `json:"bytes_done"`
+	Current    string          `json:"current,omitempty"`
+	Result     json.RawMessage `json:"result,omitempty"` // kind-specific outcome
+	CreatedAt  time.Time       `json:"created_at"`
+	StartedAt  *time.Time      `json:"started_at,omitempty"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+	UserID     string          `json:"user_id,omitempty"` // who queued it; only they and admins see it
+}
+
+const jobColumns = `id::text, kind, params, state, error, attempts, files_total, files_done,
+	bytes_total, bytes_done, current, result, created_at, started_at, finished_at, COALESCE(user_id::text, '')`
+
+func scanJob(row pgx.Row) (*job, error) {
+	var j job
+	err := row.Scan(&j.ID, &j.Kind, &j.Params, &j.State, &j.Error, &j.Attempts, &j.FilesTotal, &j.FilesDone,
+		&j.BytesTotal, &j.BytesDone, &j.Current, &j.Result, &j.CreatedAt, &j.StartedAt, &j.FinishedAt, &j.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// jobRun is a job being executed. Progress is kept in memory, served live by the API and
+// flushed to the jobs table every jobFlush.
+type jobRun struct {
+	*job
+	cancel    context.CancelCauseFunc
+	bytesDone atomic.Int64
+	result    json.RawMessage // set by the job on completion
+
+	mu         sync.Mutex
+	filesTotal int
+	filesDone  int
+	bytesTotal int64
+	current    string
+}
+
+func (r *jobRun) set(fn func()) {
+	r.mu.Lock()
+	fn()
+	r.mu.Unlock()
+}
+
+// progress copies the live progress into j.
+func (r *jobRun) progress(j *job) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	j.FilesTotal, j.FilesDone = r.filesTotal, r.filesDone
+	j.BytesTotal, j.BytesDone = r.bytesTotal, r.bytesDone.Load()
+	j.Current = r.current
+}
+
+// jobRunner tracks running jobs and wakes idle workers when jobs are queued.
+type jobRunner struct {
+	wake    chan struct{}
+	mu      sync.Mutex
+	running map[string]*jobRun
+}
+
+func newJobRunner() *jobRunner {
+	return &jobRunner{wake: make(chan struct{}, 1), running: make(map[string]*jobRun)}
+}
+
+func (jr *jobRunner) notify() {
+	select {
+	case jr.wake <- struct{}{}:
+	default:
+	}
+}
+
+// publishJob sends j to event subscribers.
+func (s *Server) publishJob(j *job) {
+	s.hub.events.publish(Event{Type: eventJob, Data: j})
+}
+
+func (jr *jobRunner) get(id string) *jobRun {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	return jr.running[id]
+}
+
+// runJobs starts the job workers and prunes old jobs until ctx is done. Jobs left running by
+// a previous bastion process are queued again.
+func (s *Server) runJobs(ctx context.Context) {
+	if _, err := s.pool.Exec(ctx, `UPDATE jobs SET state = $1 WHERE state = $2`, jobQueued, jobRunning); err != nil {
+		log.Printf("jobs: requeue: %v", err)
+	}
+	for i := 0; i < jobWorkers; i++ {
+		go s.jobWorker(ctx)
+	}
+	t := time.NewTicker(time.Hour)
+	defer t.Stop()
+	for {
+		_, err := s.pool.Exec(ctx, `DELETE FROM jobs WHERE state IN ($1, $2) AND finished_at < $3`,
+			jobDone, jobFailed, time.Now().Add(-jobRetention))
+		if err != nil && ctx.Err() == nil {
+			log.Printf("jobs: prune: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (s *Server) jobWorker(ctx context.Context) {
+	t := time.NewTicker(jobPoll)
+	defer t.Stop()
+	for {
+		j, err := s.claimJob(ctx)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) && ctx.Err() == nil {
+			log.Printf("jobs: claim: %v", err)
+		}
+		if j != nil {
+			s.jobs.notify() // there may be more; let another worker look
+			s.runJob(ctx, j)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.jobs.wake:
+		case <-t.C:
+		}
+	}
+}
+
+// claimJob marks the oldest queued job running and returns it.
+func (s *Server) claimJob(ctx context.Context) (*job, error) {
+	return scanJob(s.pool.QueryRow(ctx, `
+		UPDATE jobs SET state = $1, attempts = attempts + 1, error = '', started_at = COALESCE(started_at, now())
+		WHERE id = (SELECT id FROM jobs WHERE state = $2 ORDER BY created_at LIMIT 1 FOR UPDATE SKIP LOCKED)
+		RETURNING `+jobColumns, jobRunning, jobQueued))
+}
+
+func (s *Server) runJob(ctx context.Context, j *job) {
+	jctx, cancel := context.WithCancelCause(ctx)
+	run := &jobRun{job: j, cancel: cancel}
+	s.jobs.mu.Lock()
+	s.jobs.running[j.ID] = run
+	s.jobs.mu.Unlock()
+	s.publishJob(j)
+
+	flushDone := make(chan struct{})
+	go s.flushJobProgress(jctx, run, flushDone)
+	err := s.execJob(jctx, run)
+	cause := context.Cause(jctx)
+	cancel(nil)
+	<-flushDone
+
+	s.jobs.mu.Lock()
+	delete(s.jobs.running, j.ID)
+	s.jobs.mu.Unlock()
+
+	state, msg := jobDone, ""
+	switch {
+	case err == nil:
+	case cause == errJobCancelled:
+		state, msg = jobFailed, errJobCancelled.Error()
+	case ctx.Err() != nil:
+		state = jobQueued // bastion is shutting down; resume on next start
+	case isAgentOffline(err) && j.Attempts < jobMaxAttempts:
+		state, msg = jobPaused, err.Error()
+	default:
+		state, msg = jobFailed, err.Error()
+	}
+	if state == jobFailed && cause != errJobCancelled {
+		log.Printf("job %s (%s): %v", j.ID, j.Kind, err)
+	}
+	final := *j
+	run.progress(&final)
+	uctx, ucancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer ucancel()
+	_, uerr := s.pool.Exec(uctx, `
+		UPDATE jobs SET state = $2, error = $3, files_total = $4, files_done = $5, bytes_total = $6, bytes_done = $7,
+			current = '', result = $8, finished_at = CASE WHEN $2 IN ('done', 'failed') THEN now() END
+		WHERE id::text = $1`,
+		j.ID, state, msg, final.FilesTotal, final.FilesDone, final.BytesTotal, final.BytesDone, run.result)
+	if uerr != nil {
+		log.Printf("job %s: save state: %v", j.ID, uerr)
+		return
+	}
+	final.State, final.Error, final.Current, final.Result = state, msg, "", run.result
+	if state == jobDone || state == jobFailed {
+		now := time.Now()
+		final.FinishedAt = &now
+	}
+	s.publishJob(&final)
+	if state == jobPaused {
+		// Its agents may have reconnected while the job was failing; that includes the
+		// destination of a transfer, which other paused jobs may be waiting on too.
+		for _, a := range j.Params.agentIDs() {
+			s.resumeJobs(uctx, a)
+		}
+	}
+}
+
+func (s *Server) flushJobProgress(ctx context.Context, run *jobRun, done chan<- struct{}) {
+	defer close(done)
+	t := time.NewTicker(jobFlush)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		p := *run.job
+		run.progress(&p)
+		s.publishJob(&p)
+		_, err := s.pool.Exec(ctx, `
+			UPDATE jobs SET files_total = $2, files_done = $3, bytes_total = $4, bytes_done = $5, current = $6
+			WHERE id::text = $1`,
+			run.ID, p.FilesTotal, p.FilesDone, p.BytesTotal, p.BytesDone, p.Current)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("job %s: save progress: %v", run.ID, err)
+		}
+	}
+}
+
+func (s *Server) execJob(ctx context.Context, run *jobRun) error {
+	switch run.Kind {
+	case jobCopy, jobMove:
+		return s.runTransfer(ctx, run)
+	case jobDelete:
+		ac, err := s.jobAgent(run.Params.Agent)
+		if err != nil {
+			return err
+		}
+		run.set(func() { run.current = run.Params.Path })
+		reqID := uuid.New().String()
+		return agentOp(ctx, ac, reqID, pkg.DeleteFileRequest{Type: pkg.TypeDeleteFile, RequestID: reqID, Path: run.Params.Path})
+	case jobExtract:
+		return s.runExtract(ctx, run)
+	}
+	return fmt.Errorf("unknown job kind %q", run.Kind)
+}
+
+// jobAgent returns the connection of an agent a job needs.
+func (s *Server) jobAgent(agentID string) (*AgentConn, error) {
+	if ac := s.hub.Get(agentID); ac != nil {
+		return ac, nil
+	}
+	return nil, fmt.Errorf("%w: %s", errAgentOffline, agentID)
+}
+
+func isAgentOffline(err error) bool {
+	return errors.Is(err, errAgentOffline) || errors.Is(err, errConnClosed)
+}
+
+// resumeJobs queues paused jobs involving agentID whose agents are all connected.
+func (s *Server) resumeJobs(ctx context.Context, agentID string) {
+	rows, err := s.pool.Query(ctx, `SELECT id::text, agent_ids FROM jobs WHERE state = $1 AND $2 = ANY(agent_ids)`, jobPaused, agentID)
+	if err != nil {
+		log.Printf("jobs: resume: %v", err)
+		return
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		var agents []string
+		if err := rows.Scan(&id, &agents); err != nil {
+			log.Printf("jobs: resume: %v", err)
+			break
+		}
+		ready := true
+		for _, a := range agents {
+			ready = ready && s.hub.Connected(a)
+		}
+		if ready {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+	if len(ids) == 0 {
+		return
+	}
+	rows, err = s.pool.Query(ctx,
+		`UPDATE jobs SET state = $1 WHERE state = $2 AND id::text = ANY($3) RETURNING `+jobColumns, jobQueued, jobPaused, ids)
+	if err != nil {
+		log.Printf("jobs: resume: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			log.Printf("jobs: resume: %v", err)
+			break
+		}
+		s.publishJob(j)
+	}
+	s.jobs.notify()
+}
+
+// createJob queues a job for userID.
+func (s *Server) createJob(ctx context.Context, userID, kind string, p jobParams) (*job, error) {
+	j, err := scanJob(s.pool.QueryRow(ctx,
+		`INSERT INTO jobs (kind, params, agent_ids, user_id) VALUES ($1, $2, $3, $4) RETURNING `+jobColumns,
+		kind, p, p.agentIDs(), userID))
+	if err != nil {
+		return nil, err
+	}
+	s.jobs.notify()
+	s.publishJob(j)
+	return j, nil
+}
+
+// checkJob validates a new job against the connected agents, writing an error response and
+// returning false if it cannot run.
+func (s *Server) checkJob(w http.ResponseWriter, r *http.Request, kind string, p jobParams) bool {
+	if p.Agent == "" || p.Path == "" {
+		writeJSONError(w, http.StatusBadRequest, "agent and path required")
+		return false
+	}
+	src := s.hub.Get(p.Agent)
+	if src == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "agent not connected")
+		return false
+	}
+	switch kind {
+	case jobDelete:
+		if _, err := s.getMeta(r.Context(), src, p.Path); err != nil {
+			writeAgentError(w, err)
+			return false
+		}
+		return true
+	case jobCopy, jobMove:
+		return s.checkTransfer(w, r, src, p)
+	case jobExtract:
+		return s.checkExtract(w, r, src, p)
+	}
+	writeJSONError(w, http.StatusBadRequest, "unknown job kind")
+	return false
+}
+
+// CreateJob queues a copy, move, delete or extract. POST /api/jobs
+// {"kind","agent","path","to_agent","to_path","overwrite"}. Replies 202 with the job.
+func (s *Server) CreateJob(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Kind string `json:"kind"`
+		jobParams
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad request")
+		return
+	}
+	s.startJob(w, r, req.Kind, req.jobParams)
+}
+
+// authorizeJob checks that the user may run a job of kind on the paths in p, writing an
+// error response and returning false if not.
+func (s *Server) authorizeJob(w http.ResponseWriter, r *http.Request, kind string, p jobParams) bool {
+	var ok bool
+	switch kind {
+	case jobCopy, jobMove:
+		level := permRead
+		if kind == jobMove {
+			level = permDelete
+		}
+		_, ok = s.authorize(w, r, p.Agent, level, p.Path)
+		if ok && p.ToAgent != "" {
+			_, ok = s.authorize(w, r, p.ToAgent, permWrite, p.ToPath)
+		}
+	case jobDelete:
+		_, ok = s.authorize(w, r, p.Agent, permDelete, p.Path)
+	case jobExtract:
+		_, ok = s.authorize(w, r, p.Agent, permRead, p.Path)
+		if ok && p.ToPath != "" {
+			_, ok = s.authorize(w, r, p.Agent, permWrite, p.ToPath)
+		}
+	default:
+		return true // checkJob rejects it
+	}
+	return ok
+}
+
+func (s *Server) startJob(w http.ResponseWriter, r *http.Request, kind string, p jobParams) {
+	if !s.authorizeJob(w, r, kind, p) || !s.checkJob(w, r, kind, p) {
+		return
+	}
+	j, err := s.createJob(r.Context(), ClaimsFromContext(r.Context()).UserID, kind, p)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/jobs/"+j.ID)
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(j)
+}
+
+// ListJobs returns the user's latest jobs (everyone's for admins), newest first.
+// GET /api/jobs[?state=running]
+func (s *Server) ListJobs(w http.ResponseWriter, r *http.Request) {
+	claims := ClaimsFromContext(r.Context())
+	state := r.URL.Query().Get("state")
+	rows, err := s.pool.Query(r.Context(),
+		`SELECT `+jobColumns+` FROM jobs WHERE ($1 = '' OR state = $1) AND ($2 OR user_id::text = $3) ORDER BY created_at DESC LIMIT 200`,
+		state, claims.siteAdmin(), claims.UserID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	defer rows.Close()
+	list := []*job{}
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		if run := s.jobs.get(j.ID); run != nil {
+			run.progress(j)
+		}
+		list = append(list, j)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(list)
+}
+
+// GetJob returns one job with live progress. GET /api/jobs/:id
+func (s *Server) GetJob(w http.ResponseWriter, r *http.Request) {
+	j, ok := s.loadJob(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(j)
+}
+
+// loadJob reads the job named in the URL if the user may see it.
+func (s *Server) loadJob(w http.ResponseWriter, r *http.Request) (*job, bool) {
+	claims := ClaimsFromContext(r.Context())
+	j, err := scanJob(s.pool.QueryRow(r.Context(),
+		`SELECT `+jobColumns+` FROM jobs WHERE id::text = $1 AND ($2 OR user_id::text = $3)`, r.PathValue("id"), claims.siteAdmin(), claims.UserID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return nil, false
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return nil, false
+	}
+	if run := s.jobs.get(j.ID); run != nil {
+		run.progress(j)
+	}
+	return j, true
+}
+
+// CancelJob stops a queued, paused or running job; it ends as failed with error "cancelled".
+// Files already written stay on the destination, and a move leaves its source in place.
+// POST /api/jobs/:id/cancel
+func (s *Server) CancelJob(w http.ResponseWriter, r *http.Request) {
+	if c := ClaimsFromContext(r.Context()); c.Token != nil && c.Token.ReadOnly {
+		writeJSONError(w, http.StatusForbidden, "not allowed with a read-only API token")
+		return
+	}
+	if _, ok := s.loadJob(w, r); !ok {
+		return
+	}
+	id := r.PathValue("id")
+	if run := s.jobs.get(id); run != nil {
+		run.cancel(errJobCancelled)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	j, err := scanJob(s.pool.QueryRow(r.Context(),
+		`UPDATE jobs SET state = $2, error = $3, finished_at = now() WHERE id::text = $1 AND state IN ($4, $5) RETURNING `+jobColumns,
+		id, jobFailed, errJobCancelled.Error(), jobQueued, jobPaused))
+	if errors.Is(err, pgx.ErrNoRows) {
+		if _, ok := s.loadJob(w, r); ok {
+			writeJSONError(w, http.StatusConflict, "job is not active")
+		}
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	s.publishJob(j)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RetryJob queues a failed job again from the start, if the user still has the access it
+// needs. POST /api/jobs/:id/retry
+func (s *Server) RetryJob(w http.ResponseWriter, r *http.Request) {
+	j, ok := s.loadJob(w, r)
+	if !ok || !s.authorizeJob(w, r, j.Kind, j.Params) {
+		return
+	}
+	j, err := scanJob(s.pool.QueryRow(r.Context(), `
+		UPDATE jobs SET state = $2, error = '', attempts = 0, files_done = 0, bytes_done = 0, current = '', result = NULL, finished_at = NULL
+		WHERE id::text = $1 AND state = $3
+		RETURNING `+jobColumns, r.PathValue("id"), jobQueued, jobFailed))
+	if errors.Is(err, pgx.ErrNoRows) {
+		if _, ok := s.loadJob(w, r); ok {
+			writeJSONError(w, http.StatusConflict, "only failed jobs can be retried")
+		}
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	s.jobs.notify()
+	s.publishJob(j)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(j)
+}
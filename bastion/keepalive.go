@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"blackbox/pkg"
+
+	"github.com/gorilla/websocket"
+)
+
+// startKeepalive arms the read deadline and starts pinging the agent, so a connection that
+// went half-open (sleep, NAT timeout) is dropped after pkg.PongWait instead of looking
+// connected until a request times out. Each ping carries its send time, and the pong gives
+// the round-trip latency. Call before readLoop.
+func (ac *AgentConn) startKeepalive() {
+	ac.touch()
+	ac.conn.SetPongHandler(func(data string) error {
+		if sent, err := strconv.ParseInt(data, 10, 64); err == nil {
+			rtt := time.Since(time.Unix(0, sent))
+			ac.mu.Lock()
+			ac.rtt = rtt
+			ac.mu.Unlock()
+		}
+		ac.touch()
+		return nil
+	})
+	ac.conn.SetPingHandler(func(data string) error {
+		ac.touch()
+		// A failed pong shows up as a read error or timeout soon enough.
+		_ = ac.conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(pkg.PingTimeout))
+		return nil
+	})
+	go ac.pingLoop()
+}
+
+func (ac *AgentConn) pingLoop() {
+	t := time.NewTicker(pkg.PingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ac.done:
+			return
+		case <-t.C:
+		}
+		payload := strconv.FormatInt(time.Now().UnixNano(), 10)
+		_ = ac.conn.WriteControl(websocket.PingMessage, []byte(payload), time.Now().Add(pkg.PingTimeout))
+	}
+}
+
+// touch records that the agent was heard from and extends the read deadline. Called only
+// from the reading goroutine.
+func (ac *AgentConn) touch() {
+	now := time.Now()
+	ac.mu.Lock()
+	ac.lastSeen = now
+	ac.mu.Unlock()
+	_ = ac.conn.SetReadDeadline(now.Add(pkg.PongWait))
+}
+
+// LastSeen returns when the agent last sent anything, and the round-trip time of the last
+// ping (0 until one is answered).
+func (ac *AgentConn) LastSeen() (time.Time, time.Duration) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return ac.lastSeen, ac.rtt
+}
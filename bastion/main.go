@@ -15,6 +15,13 @@ type Server struct {
 	pool *pgxpool.Pool
 	cfg  Config
 	hub  *Hub
+	jobs *jobRunner
+	// totpFails limits wrong second-factor codes per user.
+	totpFails *failureLimiter
+	// shareFails limits wrong share passwords per share.
+	shareFails *failureLimiter
+	// uploadLocks serialises requests on the same resumable upload.
+	uploadLocks *uploadLocks
 }
 
 func main() {
@@ -32,22 +39,84 @@ func main() {
 		log.Fatalf("migrations: %v", err)
 	}
 	hub := NewHub()
-	srv := &Server{pool: pool, cfg: cfg, hub: hub}
+	srv := &Server{pool: pool, cfg: cfg, hub: hub, jobs: newJobRunner(), totpFails: newFailureLimiter(totpMaxFailures, totpChallengeExpiry),
+		shareFails: newFailureLimiter(shareMaxFailures, shareFailWindow), uploadLocks: newUploadLocks()}
+	bgCtx, stopBackground := context.WithCancel(ctx)
+	defer stopBackground()
+	go srv.runUploadJanitor(bgCtx)
+	go srv.runSessionJanitor(bgCtx)
+	go srv.runJobs(bgCtx)
+	go srv.runIndexer(bgCtx)
+	go srv.runIndexUpdates(bgCtx)
+	srv.closeStaleConnections(ctx)
+	go srv.runConnectionLog(bgCtx)
 	mux := http.NewServeMux()
 	// Auth (public)
 	mux.HandleFunc("GET /api/setup", srv.Setup)
 	mux.HandleFunc("POST /api/register", srv.Register)
 	mux.HandleFunc("POST /api/login", srv.Login)
+	mux.HandleFunc("POST /api/login/totp", srv.LoginTOTP)
 	// Protected (placeholder until step 5)
 	mux.HandleFunc("GET /api/me", srv.AuthMiddleware(srv.Me))
+	mux.HandleFunc("POST /api/logout", srv.AuthMiddleware(srv.SessionOnly(srv.Logout)))
+	mux.HandleFunc("GET /api/sessions", srv.AuthMiddleware(srv.SessionOnly(srv.ListSessions)))
+	mux.HandleFunc("DELETE /api/sessions", srv.AuthMiddleware(srv.SessionOnly(srv.RevokeOtherSessions)))
+	mux.HandleFunc("DELETE /api/sessions/{id}", srv.AuthMiddleware(srv.SessionOnly(srv.RevokeSession)))
+	mux.HandleFunc("GET /api/tokens", srv.AuthMiddleware(srv.SessionOnly(srv.ListAPITokens)))
+	mux.HandleFunc("POST /api/tokens", srv.AuthMiddleware(srv.SessionOnly(srv.CreateAPIToken)))
+	mux.HandleFunc("DELETE /api/tokens/{id}", srv.AuthMiddleware(srv.SessionOnly(srv.DeleteAPIToken)))
+	mux.HandleFunc("GET /api/2fa", srv.AuthMiddleware(srv.SessionOnly(srv.TOTPStatus)))
+	mux.HandleFunc("POST /api/2fa/setup", srv.AuthMiddleware(srv.SessionOnly(srv.SetupTOTP)))
+	mux.HandleFunc("POST /api/2fa/enable", srv.AuthMiddleware(srv.SessionOnly(srv.EnableTOTP)))
+	mux.HandleFunc("POST /api/2fa/disable", srv.AuthMiddleware(srv.SessionOnly(srv.DisableTOTP)))
+	mux.HandleFunc("GET /api/users", srv.AuthMiddleware(srv.AdminOnly(srv.ListUsers)))
+	mux.HandleFunc("POST /api/users", srv.AuthMiddleware(srv.AdminOnly(srv.CreateUserAccount)))
+	mux.HandleFunc("PATCH /api/users/{id}", srv.AuthMiddleware(srv.AdminOnly(srv.UpdateUser)))
+	mux.HandleFunc("DELETE /api/users/{id}", srv.AuthMiddleware(srv.AdminOnly(srv.DeleteUser)))
 	mux.HandleFunc("GET /api/agents", srv.AuthMiddleware(srv.ListAgents))
 	mux.HandleFunc("POST /api/agents", srv.AuthMiddleware(srv.CreateAgent))
 	mux.HandleFunc("PATCH /api/agents/{id}", srv.AuthMiddleware(srv.UpdateAgent))
 	mux.HandleFunc("DELETE /api/agents/{id}", srv.AuthMiddleware(srv.DeleteAgent))
+	mux.HandleFunc("GET /api/agents/{id}/permissions", srv.AuthMiddleware(srv.ListAgentPermissions))
+	mux.HandleFunc("POST /api/agents/{id}/permissions", srv.AuthMiddleware(srv.GrantAgentPermission))
+	mux.HandleFunc("DELETE /api/agents/{id}/permissions/{pid}", srv.AuthMiddleware(srv.RevokeAgentPermission))
+	mux.HandleFunc("POST /api/agents/{id}/shares", srv.AuthMiddleware(srv.SessionOnly(srv.CreateShare)))
 	mux.HandleFunc("GET /api/agents/{id}/files", srv.AuthMiddleware(srv.AgentFiles))
 	mux.HandleFunc("PUT /api/agents/{id}/files", srv.AuthMiddleware(srv.AgentFiles))
 	mux.HandleFunc("DELETE /api/agents/{id}/files", srv.AuthMiddleware(srv.AgentFiles))
 	mux.HandleFunc("GET /api/agents/{id}/meta", srv.AuthMiddleware(srv.AgentMeta))
+	mux.HandleFunc("POST /api/agents/{id}/rename", srv.AuthMiddleware(srv.AgentRename))
+	mux.HandleFunc("POST /api/agents/{id}/copy", srv.AuthMiddleware(srv.AgentCopy))
+	mux.HandleFunc("POST /api/agents/{id}/mkdir", srv.AuthMiddleware(srv.AgentMkdir))
+	mux.HandleFunc("GET /api/agents/{id}/hash", srv.AuthMiddleware(srv.AgentHash))
+	mux.HandleFunc("GET /api/agents/{id}/fs-events", srv.AuthMiddleware(srv.AgentFsEvents))
+	mux.HandleFunc("GET /api/agents/{id}/history", srv.AuthMiddleware(srv.AgentHistory))
+	mux.HandleFunc("GET /api/search", srv.AuthMiddleware(srv.Search))
+	mux.HandleFunc("GET /api/events", srv.AuthMiddleware(srv.Events))
+	mux.HandleFunc("POST /api/agents/{id}/extract", srv.AuthMiddleware(srv.AgentExtract))
+	// Resumable uploads (tus 1.0.0)
+	mux.HandleFunc("POST /api/agents/{id}/uploads", srv.AuthMiddleware(srv.CreateUpload))
+	mux.HandleFunc("HEAD /api/agents/{id}/uploads/{uid}", srv.AuthMiddleware(srv.UploadOffset))
+	mux.HandleFunc("GET /api/agents/{id}/uploads/{uid}", srv.AuthMiddleware(srv.UploadStatus))
+	mux.HandleFunc("PATCH /api/agents/{id}/uploads/{uid}", srv.AuthMiddleware(srv.PatchUpload))
+	mux.HandleFunc("DELETE /api/agents/{id}/uploads/{uid}", srv.AuthMiddleware(srv.DeleteUpload))
+	// Background jobs (copy, move, delete); transfers are copy/move jobs between agents
+	mux.HandleFunc("POST /api/transfers", srv.AuthMiddleware(srv.CreateTransfer))
+	mux.HandleFunc("POST /api/jobs", srv.AuthMiddleware(srv.CreateJob))
+	mux.HandleFunc("GET /api/jobs", srv.AuthMiddleware(srv.ListJobs))
+	mux.HandleFunc("GET /api/jobs/{id}", srv.AuthMiddleware(srv.GetJob))
+	mux.HandleFunc("POST /api/jobs/{id}/cancel", srv.AuthMiddleware(srv.CancelJob))
+	mux.HandleFunc("POST /api/jobs/{id}/retry", srv.AuthMiddleware(srv.RetryJob))
+	// Share links: managed by users, served to anyone with the token (the page at /s/{token}
+	// is served by the console)
+	mux.HandleFunc("GET /api/shares", srv.AuthMiddleware(srv.SessionOnly(srv.ListShares)))
+	mux.HandleFunc("DELETE /api/shares/{id}", srv.AuthMiddleware(srv.SessionOnly(srv.DeleteShare)))
+	mux.HandleFunc("GET /s/{token}/info", srv.ShareInfo)
+	mux.HandleFunc("POST /s/{token}/unlock", srv.UnlockShare)
+	mux.HandleFunc("GET /s/{token}/list", srv.ShareList)
+	mux.HandleFunc("GET /s/{token}/download", srv.ShareDownload)
+	mux.HandleFunc("HEAD /s/{token}/download", srv.ShareDownload)
+	mux.HandleFunc("PUT /s/{token}/upload", srv.ShareUpload)
 	// Agent WebSocket (no session; agent uses token)
 	mux.HandleFunc("GET /ws/agent", srv.HandleAgentWS)
 	// Static web app (SPA fallback to index.html); single pattern catches all GET requests not matched above
@@ -79,9 +148,16 @@ func corsThenMux(cfg Config, mux http.Handler) http.Handler {
 	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", origin)
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Range, If-Range, If-None-Match, If-Modified-Since, X-Content-SHA256, Digest, X-Share-Password, "+
+			"Tus-Resumable, Upload-Length, Upload-Offset, Upload-Metadata, Upload-Defer-Length")
+		w.Header().Set("Access-Control-Expose-Headers", "Content-Range, Content-Length, Content-Disposition, Accept-Ranges, ETag, Last-Modified, "+
+			"Location, X-Indexed-At, Tus-Resumable, Tus-Version, Tus-Extension, Upload-Offset, Upload-Length, Upload-Metadata, Upload-Expires")
 		if r.Method == "OPTIONS" {
+			// tus discovery: OPTIONS on any endpoint advertises the supported protocol.
+			w.Header().Set("Tus-Resumable", tusVersion)
+			w.Header().Set("Tus-Version", tusVersion)
+			w.Header().Set("Tus-Extension", tusExtensions)
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
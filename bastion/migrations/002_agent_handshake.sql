@@ -0,0 +1,4 @@
+-- Agents: protocol version, build version and capabilities from the last auth handshake.
+ALTER TABLE agents ADD COLUMN IF NOT EXISTS protocol_version INT NOT NULL DEFAULT 0;
+ALTER TABLE agents ADD COLUMN IF NOT EXISTS agent_version TEXT NOT NULL DEFAULT '';
+ALTER TABLE agents ADD COLUMN IF NOT EXISTS capabilities TEXT[] NOT NULL DEFAULT '{}';
@@ -0,0 +1,2 @@
+-- Jobs: kind-specific outcome, e.g. the per-entry report of an archive extraction.
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS result JSONB;
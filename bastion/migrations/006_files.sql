@@ -0,0 +1,18 @@
+-- Files: last-known listing of each agent's tree, kept by the indexer so offline agents can
+-- be browsed and searches need not walk every agent. path is relative to the hosted root and
+-- slash-separated; parent is the containing directory ('.' at the root).
+CREATE TABLE IF NOT EXISTS files (
+    agent_id UUID NOT NULL REFERENCES agents(id) ON DELETE CASCADE,
+    path TEXT NOT NULL,
+    parent TEXT NOT NULL,
+    name TEXT NOT NULL,
+    is_dir BOOLEAN NOT NULL,
+    size BIGINT NOT NULL DEFAULT 0,
+    mtime TIMESTAMPTZ,
+    PRIMARY KEY (agent_id, path)
+);
+
+CREATE INDEX IF NOT EXISTS idx_files_parent ON files(agent_id, parent);
+
+-- Agents: when the indexer last finished a full pass.
+ALTER TABLE agents ADD COLUMN IF NOT EXISTS indexed_at TIMESTAMPTZ;
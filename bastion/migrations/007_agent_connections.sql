@@ -0,0 +1,19 @@
+-- Agent connections: one row per WebSocket session, for last-seen, uptime and flap history.
+-- disconnected_at is NULL while the session is open; last_seen is refreshed every minute so a
+-- session cut short by a bastion restart can be closed at the right time.
+CREATE TABLE IF NOT EXISTS agent_connections (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    agent_id UUID NOT NULL REFERENCES agents(id) ON DELETE CASCADE,
+    connected_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    disconnected_at TIMESTAMPTZ,
+    last_seen TIMESTAMPTZ NOT NULL DEFAULT now(),
+    remote_addr TEXT NOT NULL DEFAULT '',
+    agent_version TEXT NOT NULL DEFAULT '',
+    protocol_version INTEGER NOT NULL DEFAULT 0,
+    reason TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS idx_agent_connections_agent ON agent_connections(agent_id, connected_at DESC);
+
+-- Agents: last traffic from the agent, for agents that are not connected.
+ALTER TABLE agents ADD COLUMN IF NOT EXISTS last_seen TIMESTAMPTZ;
@@ -0,0 +1,13 @@
+-- Users: two-factor login. totp_secret (from 001) is set once enrollment is confirmed;
+-- totp_pending holds the secret being enrolled. totp_last_step is the last TOTP time step
+-- used, so a code cannot be replayed.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_pending TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+-- Recovery codes: one-time second factors, stored as SHA-256 hex.
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL,
+    used_at TIMESTAMPTZ,
+    PRIMARY KEY (user_id, code_hash)
+);
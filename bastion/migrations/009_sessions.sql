@@ -0,0 +1,7 @@
+-- Sessions: token holds the session token's jti. expires_at slides forward while the session
+-- is used; last_used_at, user_agent and remote_addr describe it in the list of sessions.
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS last_used_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS user_agent TEXT NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS remote_addr TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
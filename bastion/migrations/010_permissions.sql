@@ -0,0 +1,23 @@
+-- Users: site admins manage users and may do everything on every agent. The first user
+-- (the only one before multi-user accounts) becomes an admin.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT false;
+UPDATE users SET is_admin = true
+WHERE id = (SELECT id FROM users ORDER BY created_at LIMIT 1) AND NOT EXISTS (SELECT 1 FROM users WHERE is_admin);
+
+-- Agent permissions: what a user may do on an agent, on path (slash-separated, relative to
+-- the hosted directory, '.' for all of it) and everything below it. Levels include the ones
+-- before them: read, write, delete, admin.
+CREATE TABLE IF NOT EXISTS agent_permissions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    agent_id UUID NOT NULL REFERENCES agents(id) ON DELETE CASCADE,
+    path TEXT NOT NULL DEFAULT '.',
+    level TEXT NOT NULL CHECK (level IN ('read', 'write', 'delete', 'admin')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (user_id, agent_id, path)
+);
+
+CREATE INDEX IF NOT EXISTS idx_agent_permissions_agent_id ON agent_permissions(agent_id);
+
+-- Jobs: who queued the job; others (except admins) do not see it.
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS user_id UUID REFERENCES users(id) ON DELETE SET NULL;
@@ -0,0 +1,18 @@
+-- Shares: links that let anyone with the token download path (mode 'read') or upload files
+-- into it (mode 'drop', a file drop) without an account. Optional password (bcrypt), expiry
+-- and download limit. A share works only while its creator may still read (or write) path.
+CREATE TABLE IF NOT EXISTS shares (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    token TEXT NOT NULL UNIQUE,
+    agent_id UUID NOT NULL REFERENCES agents(id) ON DELETE CASCADE,
+    path TEXT NOT NULL,
+    mode TEXT NOT NULL CHECK (mode IN ('read', 'drop')),
+    password_hash TEXT,
+    expires_at TIMESTAMPTZ,
+    max_downloads INTEGER,
+    downloads INTEGER NOT NULL DEFAULT 0,
+    created_by UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_shares_created_by ON shares(created_by);
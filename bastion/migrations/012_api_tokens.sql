@@ -0,0 +1,27 @@
+-- API tokens: long-lived personal tokens for scripts, sent as "Authorization: Bearer bbx_...".
+-- Only a SHA-256 of the token is kept; prefix is its start, to tell tokens apart. A token acts
+-- as its user, limited to reading if read_only, and to its api_token_scopes if scoped (a
+-- scoped token whose scopes were all removed with their agents reaches nothing).
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    prefix TEXT NOT NULL,
+    read_only BOOLEAN NOT NULL DEFAULT false,
+    scoped BOOLEAN NOT NULL DEFAULT false,
+    expires_at TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ,
+    last_used_addr TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens(user_id);
+
+-- API token scopes: the agents (and paths on them, '.' for all of it) a scoped token may use.
+CREATE TABLE IF NOT EXISTS api_token_scopes (
+    token_id UUID NOT NULL REFERENCES api_tokens(id) ON DELETE CASCADE,
+    agent_id UUID NOT NULL REFERENCES agents(id) ON DELETE CASCADE,
+    path TEXT NOT NULL DEFAULT '.',
+    PRIMARY KEY (token_id, agent_id, path)
+);
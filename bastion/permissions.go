@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	pathpkg "path"
+	"strings"
+	"time"
+
+	"blackbox/pkg"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// permLevel is what a grant in agent_permissions allows. Each level includes the ones below
+// it: write creates and changes files, delete also removes them, and admin also renames or
+// deletes the agent and manages its grants. Site admins (users.is_admin) may do everything
+// on every agent.
+type permLevel int
+
+const (
+	permNone permLevel = iota
+	permRead
+	permWrite
+	permDelete
+	permAdmin
+)
+
+var permLevelNames = [...]string{"", "read", "write", "delete", "admin"}
+
+func (l permLevel) String() string {
+	return permLevelNames[l]
+}
+
+func parsePermLevel(s string) (permLevel, bool) {
+	for i, name := range permLevelNames {
+		if i > 0 && name == s {
+			return permLevel(i), true
+		}
+	}
+	return permNone, false
+}
+
+func (l permLevel) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.String())
+}
+
+// grant gives level on Path and everything below it. Path is in index form ("." is the
+// whole agent).
+type grant struct {
+	Path  string    `json:"path"`
+	Level permLevel `json:"level"`
+}
+
+// access is what one user may do on one agent.
+type access struct {
+	all      bool // site admin
+	grants   []grant
+	readOnly bool // API token limited to reading
+}
+
+// visible reports whether the user may see the agent at all.
+func (a access) visible() bool {
+	return a.all || len(a.grants) > 0
+}
+
+// allows reports whether the user may act at level on p.
+func (a access) allows(level permLevel, p string) bool {
+	if a.readOnly && level > permRead {
+		return false
+	}
+	if a.all {
+		return true
+	}
+	for _, f := range permPaths(p) {
+		ok := false
+		for _, g := range a.grants {
+			if g.Level >= level && pathWithin(f, g.Path) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// browses reports whether p is a directory above a readable grant. Such a directory may be
+// listed, showing only the entries on the way to the grants.
+func (a access) browses(p string) bool {
+	if a.all {
+		return true
+	}
+	for _, f := range permPaths(p) {
+		ok := false
+		for _, g := range a.grants {
+			if g.Level >= permRead && g.Path != f && pathWithin(g.Path, f) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// readable reports whether p may be read or is on the way to something that may be.
+func (a access) readable(p string) bool {
+	return a.allows(permRead, p) || a.browses(p)
+}
+
+// filterEntries returns the entries of dir the user may see.
+func (a access) filterEntries(dir string, entries []pkg.FileEntry) []pkg.FileEntry {
+	if a.allows(permRead, dir) {
+		return entries
+	}
+	out := entries[:0:0]
+	for _, e := range entries {
+		if a.readable(pathpkg.Join(dir, e.Name)) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// grantsJSON is the user's grants on the agent as reported by the API.
+func (a access) grantsJSON() []grant {
+	grants := a.grants
+	if a.all {
+		grants = []grant{{Path: ".", Level: permAdmin}}
+	}
+	if !a.readOnly {
+		return grants
+	}
+	capped := make([]grant, len(grants))
+	for i, g := range grants {
+		capped[i] = grant{Path: g.Path, Level: min(g.Level, permRead)}
+	}
+	return capped
+}
+
+// permPaths returns p in index form. An agent on Windows also splits paths at backslashes,
+// so if p has any, it is returned in that reading too: a check must pass for both.
+func permPaths(p string) []string {
+	paths := []string{indexPath(p)}
+	if strings.Contains(p, `\`) {
+		paths = append(paths, indexPath(strings.ReplaceAll(p, `\`, "/")))
+	}
+	return paths
+}
+
+// pathWithin reports whether p is dir or below it; both are in index form.
+func pathWithin(p, dir string) bool {
+	return dir == "." || p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// agentAccess loads what the user behind claims may do on the agent.
+func (s *Server) agentAccess(ctx context.Context, claims *SessionClaims, agentID string) (access, error) {
+	m, err := s.userAccess(ctx, claims, agentID)
+	return accessTo(m, claims, agentID), err
+}
+
+// userAccess loads what the user may do on each agent (only agentID, if set). Site admins
+// get a nil map; use accessTo to read it.
+func (s *Server) userAccess(ctx context.Context, claims *SessionClaims, agentID string) (map[string]access, error) {
+	if claims.Admin {
+		return nil, nil
+	}
+	rows, err := s.pool.Query(ctx,
+		`SELECT agent_id::text, path, level FROM agent_permissions WHERE user_id::text = $1 AND ($2 = '' OR agent_id::text = $2)`,
+		claims.UserID, agentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	m := make(map[string]access)
+	for rows.Next() {
+		var id, p, level string
+		if err := rows.Scan(&id, &p, &level); err != nil {
+			return nil, err
+		}
+		l, ok := parsePermLevel(level)
+		if !ok {
+			continue
+		}
+		a := m[id]
+		a.grants = append(a.grants, grant{Path: p, Level: l})
+		m[id] = a
+	}
+	return m, rows.Err()
+}
+
+// accessTo reads a map from userAccess, limited to the scopes of the API token used, if any.
+func accessTo(m map[string]access, claims *SessionClaims, agentID string) access {
+	a := m[agentID]
+	if claims.Admin {
+		a = access{all: true}
+	}
+	return claims.Token.restrict(agentID, a)
+}
+
+// authorize checks that the user may act at level on each of paths of the agent ("." is the
+// whole agent), or only that the user may see the agent if no paths are given. Otherwise it
+// writes 404 (the agent is hidden from the user) or 403 and returns false.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, agentID string, level permLevel, paths ...string) (access, bool) {
+	a, err := s.agentAccess(r.Context(), ClaimsFromContext(r.Context()), agentID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return a, false
+	}
+	if !a.visible() {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return a, false
+	}
+	for _, p := range paths {
+		if !a.allows(level, p) {
+			writePermissionDenied(w, level, p)
+			return a, false
+		}
+	}
+	return a, true
+}
+
+func writePermissionDenied(w http.ResponseWriter, level permLevel, p string) {
+	writeJSONError(w, http.StatusForbidden, "permission denied: "+level.String()+" on "+indexPath(p))
+}
+
+// AdminOnly lets only site admins through (not with a restricted API token). Wrap inside
+// AuthMiddleware.
+func (s *Server) AdminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c := ClaimsFromContext(r.Context()); c == nil || !c.siteAdmin() {
+			writeJSONError(w, http.StatusForbidden, "admin only")
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// agentPermission is a row of the agent_permissions table.
+type agentPermission struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Username  string    `json:"username"`
+	Path      string    `json:"path"`
+	Level     string    `json:"level"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ListAgentPermissions lists who was granted what on the agent. Agent admins only.
+// GET /api/agents/:id/permissions
+func (s *Server) ListAgentPermissions(w http.ResponseWriter, r *http.Request) {
+	agentID := r.PathValue("id")
+	if _, ok := s.authorize(w, r, agentID, permAdmin, "."); !ok {
+		return
+	}
+	rows, err := s.pool.Query(r.Context(),
+		`SELECT p.id::text, p.user_id::text, u.username, p.path, p.level, p.created_at
+		 FROM agent_permissions p JOIN users u ON u.id = p.user_id
+		 WHERE p.agent_id::text = $1 ORDER BY u.username, p.path`, agentID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	defer rows.Close()
+	list := []agentPermission{}
+	for rows.Next() {
+		var p agentPermission
+		if err := rows.Scan(&p.ID, &p.UserID, &p.Username, &p.Path, &p.Level, &p.CreatedAt); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		list = append(list, p)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(list)
+}
+
+// GrantAgentPermission gives a user level on path (default the whole agent), replacing the
+// user's grant on that same path. Agent admins only.
+// POST /api/agents/:id/permissions {"username","path","level"}
+func (s *Server) GrantAgentPermission(w http.ResponseWriter, r *http.Request) {
+	agentID := r.PathValue("id")
+	if _, ok := s.authorize(w, r, agentID, permAdmin, "."); !ok {
+		return
+	}
+	var req struct {
+		Username string `json:"username"`
+		Path     string `json:"path"`
+		Level    string `json:"level"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad request")
+		return
+	}
+	if _, ok := parsePermLevel(req.Level); !ok {
+		writeJSONError(w, http.StatusBadRequest, "level must be read, write, delete or admin")
+		return
+	}
+	if strings.Contains(req.Path, `\`) {
+		writeJSONError(w, http.StatusBadRequest, "path must use forward slashes")
+		return
+	}
+	user, err := GetUserByUsername(r.Context(), s.pool, req.Username)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSONError(w, http.StatusBadRequest, "no such user")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	p := agentPermission{UserID: user.ID, Username: user.Username, Path: indexPath(req.Path), Level: req.Level}
+	err = s.pool.QueryRow(r.Context(), `
+		INSERT INTO agent_permissions (user_id, agent_id, path, level) SELECT $1, a.id, $3, $4 FROM agents a WHERE a.id::text = $2
+		ON CONFLICT (user_id, agent_id, path) DO UPDATE SET level = EXCLUDED.level
+		RETURNING id::text, created_at`,
+		user.ID, agentID, p.Path, p.Level).Scan(&p.ID, &p.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(p)
+}
+
+// RevokeAgentPermission removes a grant. Agent admins only.
+// DELETE /api/agents/:id/permissions/:pid
+func (s *Server) RevokeAgentPermission(w http.ResponseWriter, r *http.Request) {
+	agentID := r.PathValue("id")
+	if _, ok := s.authorize(w, r, agentID, permAdmin, "."); !ok {
+		return
+	}
+	result, err := s.pool.Exec(r.Context(),
+		`DELETE FROM agent_permissions WHERE id::text = $1 AND agent_id::text = $2`, r.PathValue("pid"), agentID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if result.RowsAffected() == 0 {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
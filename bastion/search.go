@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"blackbox/pkg"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	searchDefaultLimit = 100
+	searchMaxLimit     = 1000
+)
+
+// searchMatch is a match in the merged results of GET /api/search. Stale matches come from
+// the index of an agent that is not connected.
+type searchMatch struct {
+	AgentID string `json:"agent_id"`
+	pkg.SearchMatch
+	Stale bool `json:"stale,omitempty"`
+}
+
+// searchAgent is the outcome of the search on one agent.
+type searchAgent struct {
+	AgentID   string     `json:"agent_id"`
+	Matches   int        `json:"matches"`
+	Truncated bool       `json:"truncated,omitempty"`
+	IndexedAt *time.Time `json:"indexed_at,omitempty"` // set when the results came from the index
+	Stale     bool       `json:"stale,omitempty"`      // from the index of an agent that is not connected
+	Error     string     `json:"error,omitempty"`
+}
+
+// Search finds files by name and optionally content on all agents (or one, with agent=).
+// GET /api/search?q=...&content=...&regex=1&path=...&agent=...&limit=...&live=1
+//
+// q is a case-insensitive glob on names; a plain word matches names containing it. content
+// keeps only text files containing that string. With regex=1 both are regular expressions.
+//
+// Name searches are answered from the files index, including agents that are offline (their
+// matches are marked stale). Content searches, live=1 and agents not indexed yet go to the
+// connected agents in parallel for up to proxyTimeout; matches found by an agent that times
+// out or fails are still returned, and its error is reported in "agents".
+//
+// Only agents and paths the user may read are searched and returned.
+func (s *Server) Search(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	req := pkg.SearchRequest{
+		Type:    pkg.TypeSearch,
+		Path:    q.Get("path"),
+		Name:    q.Get("q"),
+		Content: q.Get("content"),
+		Regex:   q.Get("regex") == "1",
+	}
+	if req.Name == "" && req.Content == "" {
+		writeJSONError(w, http.StatusBadRequest, "q or content required")
+		return
+	}
+	if req.Path == "" {
+		req.Path = "."
+	}
+	if req.Name != "" && !req.Regex && !strings.ContainsAny(req.Name, `*?[\`) {
+		req.Name = "*" + req.Name + "*"
+	}
+	if err := checkSearchPatterns(req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	limit := searchDefaultLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > searchMaxLimit {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("limit must be 1-%d", searchMaxLimit))
+			return
+		}
+		limit = n
+	}
+	// One match past the limit tells whether the merged list was cut.
+	req.Limit = limit + 1
+	ctx, cancel := context.WithTimeout(r.Context(), proxyTimeout)
+	defer cancel()
+	agentID := q.Get("agent")
+	claims := ClaimsFromContext(r.Context())
+	acc, err := s.userAccess(ctx, claims, agentID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if agentID != "" && !accessTo(acc, claims, agentID).visible() {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	visible := func(id string) bool { return accessTo(acc, claims, id).visible() }
+	var matches []searchMatch
+	var results []searchAgent
+	if req.Content == "" && q.Get("live") != "1" {
+		matches, results, err = s.searchIndex(ctx, req, agentID, visible)
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "2201B" {
+			writeJSONError(w, http.StatusBadRequest, "invalid pattern: "+pgErr.Message)
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+	} else {
+		var agents []*AgentConn
+		for _, ac := range s.hub.List() {
+			if visible(ac.AgentID) {
+				agents = append(agents, ac)
+			}
+		}
+		if agentID != "" {
+			ac := s.hub.Get(agentID)
+			if ac == nil {
+				writeJSONError(w, http.StatusServiceUnavailable, "agent not connected")
+				return
+			}
+			agents = []*AgentConn{ac}
+		}
+		matches, results = searchLive(ctx, req, agents)
+	}
+	for i := range results {
+		if results[i].Matches > limit {
+			results[i].Truncated = true
+		}
+	}
+	if !claims.siteAdmin() {
+		// Counted before filtering, so truncation still shows when the agent stopped early.
+		matches = readableMatches(matches, results, acc, claims)
+	}
+	if matches == nil {
+		matches = []searchMatch{}
+	}
+	if results == nil {
+		results = []searchAgent{}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].AgentID < results[j].AgentID })
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Path != matches[j].Path {
+			return matches[i].Path < matches[j].Path
+		}
+		return matches[i].AgentID < matches[j].AgentID
+	})
+	truncated := len(matches) > limit
+	if truncated {
+		matches = matches[:limit]
+	}
+	for _, res := range results {
+		truncated = truncated || res.Truncated
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"matches":   matches,
+		"agents":    results,
+		"truncated": truncated,
+	})
+}
+
+// readableMatches drops the matches the user may not read and recounts the matches of each
+// agent in results.
+func readableMatches(matches []searchMatch, results []searchAgent, acc map[string]access, claims *SessionClaims) []searchMatch {
+	out := matches[:0]
+	count := make(map[string]int)
+	for _, m := range matches {
+		if accessTo(acc, claims, m.AgentID).allows(permRead, m.Path) {
+			count[m.AgentID]++
+			out = append(out, m)
+		}
+	}
+	for i := range results {
+		results[i].Matches = count[results[i].AgentID]
+	}
+	return out
+}
+
+// searchLive runs req on each agent in parallel and collects the matches, including those
+// sent before an agent failed or ran out of time.
+func searchLive(ctx context.Context, req pkg.SearchRequest, agents []*AgentConn) ([]searchMatch, []searchAgent) {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		matches []searchMatch
+		results = make([]searchAgent, len(agents))
+	)
+	for i, ac := range agents {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := &results[i]
+			res.AgentID = ac.AgentID
+			resp, err := ac.Search(ctx, req, func(m []pkg.SearchMatch) {
+				mu.Lock()
+				defer mu.Unlock()
+				for _, sm := range m {
+					matches = append(matches, searchMatch{AgentID: ac.AgentID, SearchMatch: sm})
+				}
+				res.Matches += len(m)
+			})
+			switch {
+			case errors.Is(err, context.DeadlineExceeded):
+				res.Error = "timed out"
+				res.Truncated = true
+			case err != nil:
+				res.Error = err.Error()
+			default:
+				res.Truncated = resp.Truncated
+			}
+		}()
+	}
+	wg.Wait()
+	return matches, results
+}
+
+// searchIndex matches req.Name against the files table of the agents for which visible
+// returns true. Agents that have never been indexed are searched live if connected.
+func (s *Server) searchIndex(ctx context.Context, req pkg.SearchRequest, agentID string, visible func(string) bool) ([]searchMatch, []searchAgent, error) {
+	rows, err := s.pool.Query(ctx, `SELECT id::text, indexed_at FROM agents WHERE $1 = '' OR id::text = $1`, agentID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var results []searchAgent
+	var indexed []string
+	var live []*AgentConn
+	for rows.Next() {
+		res := searchAgent{}
+		if err := rows.Scan(&res.AgentID, &res.IndexedAt); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		if !visible(res.AgentID) {
+			continue
+		}
+		ac := s.hub.Get(res.AgentID)
+		switch {
+		case res.IndexedAt != nil:
+			res.Stale = ac == nil
+			indexed = append(indexed, res.AgentID)
+		case ac != nil:
+			live = append(live, ac)
+			continue
+		default:
+			res.Error = "agent not connected and not indexed yet"
+		}
+		results = append(results, res)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	op, pattern := "~*", globRegexp(req.Name)
+	if req.Regex {
+		op, pattern = "~", req.Name
+	}
+	dir := indexPath(req.Path)
+	rows, err = s.pool.Query(ctx,
+		`SELECT agent_id::text, path, is_dir, size, mtime FROM files
+		 WHERE agent_id::text = ANY($1) AND name `+op+` $2 AND ($3 = '.' OR left(path, char_length($3) + 1) = $3 || '/')
+		 ORDER BY path, agent_id LIMIT $4`,
+		indexed, pattern, dir, req.Limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var matches []searchMatch
+	count := make(map[string]int)
+	for rows.Next() {
+		var m searchMatch
+		var mtime *time.Time
+		if err := rows.Scan(&m.AgentID, &m.Path, &m.IsDir, &m.Size, &mtime); err != nil {
+			return nil, nil, err
+		}
+		if mtime != nil {
+			m.Mtime = mtime.Format(time.RFC3339)
+		}
+		m.Stale = !s.hub.Connected(m.AgentID)
+		count[m.AgentID]++
+		matches = append(matches, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	for i := range results {
+		results[i].Matches = count[results[i].AgentID]
+	}
+	if len(live) > 0 {
+		m, res := searchLive(ctx, req, live)
+		matches = append(matches, m...)
+		results = append(results, res...)
+	}
+	return matches, results, nil
+}
+
+// globRegexp translates a path.Match pattern into an anchored regular expression for
+// Postgres, so name searches against the index match what the agents would.
+func globRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			}
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			b.WriteString(glob[i : i+end+2])
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// checkSearchPatterns rejects patterns the agents would refuse, before fanning out.
+func checkSearchPatterns(req pkg.SearchRequest) error {
+	if req.Regex {
+		for _, p := range []string{req.Name, req.Content} {
+			if _, err := regexp.Compile(p); err != nil {
+				return fmt.Errorf("invalid pattern: %v", err)
+			}
+		}
+		return nil
+	}
+	if _, err := path.Match(req.Name, ""); err != nil {
+		return fmt.Errorf("invalid pattern: %v", err)
+	}
+	return nil
+}
+
+// Search runs req on the agent, calling fn with each batch of matches as it arrives. Matches
+// delivered before an error are kept by the caller.
+func (ac *AgentConn) Search(ctx context.Context, req pkg.SearchRequest, fn func([]pkg.SearchMatch)) (*pkg.SearchResponse, error) {
+	if err := ac.require(pkg.TypeSearch); err != nil {
+		return nil, err
+	}
+	req.RequestID = uuid.New().String()
+	data, err := ac.requestStream(ctx, req.RequestID, req, func(data json.RawMessage) error {
+		var msg pkg.SearchMatches
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return fmt.Errorf("invalid response")
+		}
+		fn(msg.Matches)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var resp pkg.SearchResponse
+	if json.Unmarshal(data, &resp) != nil {
+		return nil, fmt.Errorf("invalid response")
+	}
+	if resp.Error != "" {
+		return nil, &AgentError{Msg: resp.Error}
+	}
+	return &resp, nil
+}
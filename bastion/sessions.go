@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Console sessions live in the sessions table, so they can be listed and revoked. The session
+// token is a JWT whose jti is the row's token; a token without a live row is refused.
+
+const maxUserAgent = 512 // longest user agent kept for the list of sessions
+
+var errNoSession = errors.New("session revoked or expired")
+
+// createSession records a new session for user and returns its token.
+func (s *Server) createSession(r *http.Request, user *User) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	jti := base64.RawURLEncoding.EncodeToString(b)
+	_, err := s.pool.Exec(r.Context(),
+		`INSERT INTO sessions (user_id, token, expires_at, user_agent, remote_addr) VALUES ($1, $2, $3, $4, $5)`,
+		user.ID, jti, time.Now().Add(sessionExpiry), userAgent(r), remoteIP(r))
+	if err != nil {
+		return "", err
+	}
+	return IssueToken(jti, user.ID, user.Username, s.cfg.JWTSecret, sessionMaxAge)
+}
+
+// useSession looks up the live session behind claims and sets claims.SessionID and
+// claims.Admin, or returns errNoSession. At most every sessionTouchInterval it records the use
+// and moves the expiry forward (sliding refresh), renewing the cookie too if token came from it.
+func (s *Server) useSession(w http.ResponseWriter, r *http.Request, claims *SessionClaims, token string) error {
+	var id string
+	var lastUsed time.Time
+	err := s.pool.QueryRow(r.Context(),
+		`SELECT s.id::text, s.last_used_at, u.is_admin FROM sessions s JOIN users u ON u.id = s.user_id
+		 WHERE s.token = $1 AND s.user_id::text = $2 AND s.expires_at > now()`,
+		claims.ID, claims.UserID).Scan(&id, &lastUsed, &claims.Admin)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return errNoSession
+	}
+	if err != nil {
+		return err
+	}
+	claims.SessionID = id
+	if time.Since(lastUsed) < sessionTouchInterval {
+		return nil
+	}
+	expires := time.Now().Add(sessionExpiry)
+	_, err = s.pool.Exec(r.Context(),
+		`UPDATE sessions SET last_used_at = now(), expires_at = $2, user_agent = $3, remote_addr = $4 WHERE id::text = $1`,
+		id, expires, userAgent(r), remoteIP(r))
+	if err != nil {
+		// The session is valid; failing to extend it only shortens it.
+		log.Printf("sessions: touch: %v", err)
+		return nil
+	}
+	if c, _ := r.Cookie("session"); c != nil && c.Value == token {
+		setSessionCookie(w, token)
+	}
+	return nil
+}
+
+// setSessionCookie sets the session cookie to token for sessionExpiry, or deletes it if
+// token is empty.
+func setSessionCookie(w http.ResponseWriter, token string) {
+	maxAge := int(sessionExpiry.Seconds())
+	if token == "" {
+		maxAge = -1
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session",
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// remoteIP is the client address of r without the port.
+func remoteIP(r *http.Request) string {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return addr
+}
+
+func userAgent(r *http.Request) string {
+	ua := r.UserAgent()
+	if len(ua) > maxUserAgent {
+		ua = ua[:maxUserAgent]
+	}
+	return ua
+}
+
+// runSessionJanitor deletes expired sessions every hour until ctx is done.
+func (s *Server) runSessionJanitor(ctx context.Context) {
+	t := time.NewTicker(time.Hour)
+	defer t.Stop()
+	for {
+		if _, err := s.pool.Exec(ctx, `DELETE FROM sessions WHERE expires_at < now()`); err != nil && ctx.Err() == nil {
+			log.Printf("sessions: expire: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Logout ends the current session. POST /api/logout
+func (s *Server) Logout(w http.ResponseWriter, r *http.Request) {
+	claims := ClaimsFromContext(r.Context())
+	if _, err := s.pool.Exec(r.Context(), `DELETE FROM sessions WHERE id::text = $1`, claims.SessionID); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	setSessionCookie(w, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sessionInfo is a row of the sessions table as listed to its user.
+type sessionInfo struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent"`
+	RemoteAddr string    `json:"remote_addr"`
+	Current    bool      `json:"current"` // the session making the request
+}
+
+// ListSessions lists the user's active sessions, most recently used first. GET /api/sessions
+func (s *Server) ListSessions(w http.ResponseWriter, r *http.Request) {
+	claims := ClaimsFromContext(r.Context())
+	rows, err := s.pool.Query(r.Context(),
+		`SELECT id::text, created_at, last_used_at, expires_at, user_agent, remote_addr
+		 FROM sessions WHERE user_id::text = $1 AND expires_at > now() ORDER BY last_used_at DESC`, claims.UserID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	defer rows.Close()
+	list := []sessionInfo{}
+	for rows.Next() {
+		var si sessionInfo
+		if err := rows.Scan(&si.ID, &si.CreatedAt, &si.LastUsedAt, &si.ExpiresAt, &si.UserAgent, &si.RemoteAddr); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		si.Current = si.ID == claims.SessionID
+		list = append(list, si)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(list)
+}
+
+// RevokeSession ends one of the user's sessions. DELETE /api/sessions/:id
+func (s *Server) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	claims := ClaimsFromContext(r.Context())
+	id := r.PathValue("id")
+	result, err := s.pool.Exec(r.Context(), `DELETE FROM sessions WHERE id::text = $1 AND user_id::text = $2`, id, claims.UserID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if result.RowsAffected() == 0 {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if id == claims.SessionID {
+		setSessionCookie(w, "")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeOtherSessions signs the user out everywhere but the current session.
+// DELETE /api/sessions
+func (s *Server) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	claims := ClaimsFromContext(r.Context())
+	result, err := s.pool.Exec(r.Context(), `DELETE FROM sessions WHERE user_id::text = $1 AND id::text <> $2`, claims.UserID, claims.SessionID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int64{"revoked": result.RowsAffected()})
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	pathpkg "path"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+// Share links hand a file or folder to someone without an account. The console creates them
+// under /api; the /s/{token} routes serve them without authentication. Read shares download
+// (folders also list), drop shares only take new files. A share works only while its creator
+// may still read (drop: write) its path, so revoking a grant also stops the creator's shares.
+
+const (
+	shareModeRead = "read"
+	shareModeDrop = "drop"
+
+	shareUnlockExpiry = 12 * time.Hour // how long a correct password unlocks a share
+	shareMaxFailures  = 10             // wrong passwords per share per shareFailWindow
+	shareFailWindow   = 15 * time.Minute
+)
+
+// share is a row of the shares table.
+type share struct {
+	ID           string     `json:"id"`
+	Token        string     `json:"token"`
+	URL          string     `json:"url"` // path of the public link, /s/{token}
+	AgentID      string     `json:"agent_id"`
+	AgentLabel   string     `json:"agent_label"`
+	Path         string     `json:"path"`
+	Mode         string     `json:"mode"`
+	Password     bool       `json:"password"` // whether the share asks for a password
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	MaxDownloads *int       `json:"max_downloads,omitempty"`
+	Downloads    int        `json:"downloads"`
+	CreatedBy    string     `json:"created_by"` // username
+	CreatedAt    time.Time  `json:"created_at"`
+
+	passwordHash string
+	creatorID    string
+	creatorAdmin bool
+}
+
+const shareColumns = `s.id::text, s.token, s.agent_id::text, a.label, s.path, s.mode, COALESCE(s.password_hash, ''),
+	s.expires_at, s.max_downloads, s.downloads, s.created_by::text, u.username, u.is_admin, s.created_at`
+
+const shareFrom = ` FROM shares s JOIN agents a ON a.id = s.agent_id JOIN users u ON u.id = s.created_by`
+
+func scanShare(row pgx.Row) (*share, error) {
+	var sh share
+	err := row.Scan(&sh.ID, &sh.Token, &sh.AgentID, &sh.AgentLabel, &sh.Path, &sh.Mode, &sh.passwordHash,
+		&sh.ExpiresAt, &sh.MaxDownloads, &sh.Downloads, &sh.creatorID, &sh.CreatedBy, &sh.creatorAdmin, &sh.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	sh.URL = "/s/" + sh.Token
+	sh.Password = sh.passwordHash != ""
+	return &sh, nil
+}
+
+// level is what the share's creator must be allowed on its path.
+func (sh *share) level() permLevel {
+	if sh.Mode == shareModeDrop {
+		return permWrite
+	}
+	return permRead
+}
+
+// target resolves sub, a path relative to the share, to a path on the agent inside the share.
+func (sh *share) target(sub string) (string, bool) {
+	if strings.Contains(sub, `\`) {
+		return "", false
+	}
+	p := indexPath(pathpkg.Join(sh.Path, sub))
+	return p, pathWithin(p, sh.Path)
+}
+
+// CreateShare creates a share link for path on the agent. Read shares need read on path,
+// drops need write on a folder. POST /api/agents/:id/shares
+// {"path","mode","password","expires_at","max_downloads"}
+func (s *Server) CreateShare(w http.ResponseWriter, r *http.Request) {
+	agentID := r.PathValue("id")
+	var req struct {
+		Path         string     `json:"path"`
+		Mode         string     `json:"mode"`
+		Password     string     `json:"password"`
+		ExpiresAt    *time.Time `json:"expires_at"`
+		MaxDownloads *int       `json:"max_downloads"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad request")
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = shareModeRead
+	}
+	switch {
+	case req.Mode != shareModeRead && req.Mode != shareModeDrop:
+		writeJSONError(w, http.StatusBadRequest, "mode must be read or drop")
+		return
+	case strings.Contains(req.Path, `\`):
+		writeJSONError(w, http.StatusBadRequest, "path must use forward slashes")
+		return
+	case req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()):
+		writeJSONError(w, http.StatusBadRequest, "expires_at must be in the future")
+		return
+	case req.MaxDownloads != nil && *req.MaxDownloads < 1:
+		writeJSONError(w, http.StatusBadRequest, "max_downloads must be at least 1")
+		return
+	case req.MaxDownloads != nil && req.Mode == shareModeDrop:
+		writeJSONError(w, http.StatusBadRequest, "max_downloads applies to read shares only")
+		return
+	}
+	sh := &share{AgentID: agentID, Path: indexPath(req.Path), Mode: req.Mode}
+	if _, ok := s.authorize(w, r, agentID, sh.level(), sh.Path); !ok {
+		return
+	}
+	ac := s.hub.Get(agentID)
+	if ac == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "agent not connected")
+		return
+	}
+	meta, err := s.getMeta(r.Context(), ac, sh.Path)
+	if err != nil {
+		writeAgentError(w, err)
+		return
+	}
+	if sh.Mode == shareModeDrop && !meta.IsDir {
+		writeJSONError(w, http.StatusBadRequest, "a file drop needs a folder")
+		return
+	}
+	var hash *string
+	if req.Password != "" {
+		h, err := HashPassword(req.Password)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		hash = &h
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	sh, err = scanShare(s.pool.QueryRow(r.Context(), `
+		WITH s AS (
+			INSERT INTO shares (token, agent_id, path, mode, password_hash, expires_at, max_downloads, created_by)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING *
+		) SELECT `+shareColumns+` FROM s JOIN agents a ON a.id = s.agent_id JOIN users u ON u.id = s.created_by`,
+		token, agentID, sh.Path, sh.Mode, hash, req.ExpiresAt, req.MaxDownloads, ClaimsFromContext(r.Context()).UserID))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(sh)
+}
+
+// ListShares lists the user's shares (all shares for admins), newest first. GET /api/shares
+func (s *Server) ListShares(w http.ResponseWriter, r *http.Request) {
+	claims := ClaimsFromContext(r.Context())
+	rows, err := s.pool.Query(r.Context(),
+		`SELECT `+shareColumns+shareFrom+` WHERE $1 OR s.created_by::text = $2 ORDER BY s.created_at DESC`,
+		claims.siteAdmin(), claims.UserID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	defer rows.Close()
+	list := []*share{}
+	for rows.Next() {
+		sh, err := scanShare(rows)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		list = append(list, sh)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(list)
+}
+
+// DeleteShare revokes one of the user's shares (any share, for admins).
+// DELETE /api/shares/:id
+func (s *Server) DeleteShare(w http.ResponseWriter, r *http.Request) {
+	claims := ClaimsFromContext(r.Context())
+	result, err := s.pool.Exec(r.Context(), `DELETE FROM shares WHERE id::text = $1 AND ($2 OR created_by::text = $3)`,
+		r.PathValue("id"), claims.siteAdmin(), claims.UserID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if result.RowsAffected() == 0 {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// openShare loads the share named by the token in r and checks that it can be used, and if
+// unlock is set, that its password was given. Otherwise it writes the error and returns false.
+func (s *Server) openShare(w http.ResponseWriter, r *http.Request, unlock bool) (*share, bool) {
+	sh, err := scanShare(s.pool.QueryRow(r.Context(), `SELECT `+shareColumns+shareFrom+` WHERE s.token = $1`, r.PathValue("token")))
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return nil, false
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return nil, false
+	}
+	if sh.ExpiresAt != nil && time.Now().After(*sh.ExpiresAt) {
+		writeJSONError(w, http.StatusGone, "share expired")
+		return nil, false
+	}
+	acc, err := s.agentAccess(r.Context(), &SessionClaims{UserID: sh.creatorID, Admin: sh.creatorAdmin}, sh.AgentID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return nil, false
+	}
+	if !acc.allows(sh.level(), sh.Path) {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return nil, false
+	}
+	if unlock && sh.Password && !s.shareUnlocked(r, sh) {
+		writeJSONError(w, http.StatusUnauthorized, "password required")
+		return nil, false
+	}
+	return sh, true
+}
+
+// shareUnlocked reports whether r carries the unlock cookie of sh or its password in the
+// X-Share-Password header.
+func (s *Server) shareUnlocked(r *http.Request, sh *share) bool {
+	if c, err := r.Cookie("share"); err == nil {
+		if id, err := validateShareUnlock(c.Value, s.cfg.JWTSecret); err == nil && id == sh.ID {
+			return true
+		}
+	}
+	password := r.Header.Get("X-Share-Password")
+	return password != "" && s.checkSharePassword(sh, password)
+}
+
+// checkSharePassword checks password against sh, counting wrong ones.
+func (s *Server) checkSharePassword(sh *share, password string) bool {
+	if !s.shareFails.allowed(sh.ID) {
+		return false
+	}
+	if !CheckPassword(sh.passwordHash, password) {
+		s.shareFails.fail(sh.ID)
+		return false
+	}
+	s.shareFails.reset(sh.ID)
+	return true
+}
+
+// shareUnlockKey signs unlock cookies, apart from sessions and TOTP challenges.
+func shareUnlockKey(jwtSecret string) []byte {
+	return []byte("share\x00" + jwtSecret)
+}
+
+func issueShareUnlock(shareID, jwtSecret string) (string, error) {
+	claims := jwt.RegisteredClaims{
+		Subject:   shareID,
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(shareUnlockExpiry)),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(shareUnlockKey(jwtSecret))
+}
+
+// validateShareUnlock returns the share ID of a valid unlock cookie.
+func validateShareUnlock(token, jwtSecret string) (string, error) {
+	var claims jwt.RegisteredClaims
+	t, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return shareUnlockKey(jwtSecret), nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if !t.Valid || claims.Subject == "" {
+		return "", jwt.ErrTokenInvalidClaims
+	}
+	return claims.Subject, nil
+}
+
+// writeShareError answers a failed agent request on a share. Agent messages can name paths on
+// the host, so they are not passed on.
+func writeShareError(w http.ResponseWriter, err error) {
+	var agentErr *AgentError
+	var unsupported *unsupportedError
+	switch {
+	case errors.As(err, &agentErr):
+		writeJSONError(w, http.StatusNotFound, "not found")
+	case errors.As(err, &unsupported):
+		writeJSONError(w, http.StatusNotImplemented, unsupported.Error())
+	default:
+		writeJSONError(w, http.StatusBadGateway, "agent unavailable")
+	}
+}
+
+// ShareInfo describes a share to its visitor. Until the password is given it only tells
+// that one is needed. GET /s/:token/info
+func (s *Server) ShareInfo(w http.ResponseWriter, r *http.Request) {
+	sh, ok := s.openShare(w, r, false)
+	if !ok {
+		return
+	}
+	info := map[string]interface{}{
+		"mode":       sh.Mode,
+		"password":   sh.Password,
+		"unlocked":   !sh.Password || s.shareUnlocked(r, sh),
+		"expires_at": sh.ExpiresAt,
+	}
+	if sh.MaxDownloads != nil {
+		info["downloads_left"] = max(*sh.MaxDownloads-sh.Downloads, 0)
+	}
+	if info["unlocked"] == true {
+		name := pathpkg.Base(sh.Path)
+		if name == "." {
+			name = sh.AgentLabel
+		}
+		info["name"] = name
+		ac := s.hub.Get(sh.AgentID)
+		info["connected"] = ac != nil
+		if ac != nil {
+			if meta, err := s.getMeta(r.Context(), ac, sh.Path); err == nil {
+				info["is_dir"] = meta.IsDir
+				info["size"] = meta.Size
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(info)
+}
+
+// UnlockShare checks the share's password and sets a cookie that unlocks it for
+// shareUnlockExpiry. POST /s/:token/unlock {"password"}
+func (s *Server) UnlockShare(w http.ResponseWriter, r *http.Request) {
+	sh, ok := s.openShare(w, r, false)
+	if !ok {
+		return
+	}
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad request")
+		return
+	}
+	if !sh.Password {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if !s.shareFails.allowed(sh.ID) {
+		writeJSONError(w, http.StatusTooManyRequests, "too many wrong passwords, try again later")
+		return
+	}
+	if !s.checkSharePassword(sh, req.Password) {
+		writeJSONError(w, http.StatusUnauthorized, "wrong password")
+		return
+	}
+	token, err := issueShareUnlock(sh.ID, s.cfg.JWTSecret)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "share",
+		Value:    token,
+		Path:     sh.URL,
+		MaxAge:   int(shareUnlockExpiry.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ShareList lists a folder of a read share. GET /s/:token/list?path=
+func (s *Server) ShareList(w http.ResponseWriter, r *http.Request) {
+	_, p, ac, ok := s.openShareTarget(w, r, shareModeRead, r.URL.Query().Get("path"))
+	if !ok {
+		return
+	}
+	entries, err := s.listDir(r.Context(), ac, p)
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(entries)
+}
+
+// ShareDownload downloads a read share, or a file or folder in it (folders as an archive, see
+// format=). Each GET that is served from the start counts against max_downloads: a full (200)
+// response, or a partial one beginning at byte 0 or made of several ranges. A single range that
+// resumes a download further on does not. GET/HEAD /s/:token/download?path=&format=
+func (s *Server) ShareDownload(w http.ResponseWriter, r *http.Request) {
+	sh, p, ac, ok := s.openShareTarget(w, r, shareModeRead, r.URL.Query().Get("path"))
+	if !ok {
+		return
+	}
+	if sh.MaxDownloads != nil && sh.Downloads >= *sh.MaxDownloads {
+		writeJSONError(w, http.StatusGone, "download limit reached")
+		return
+	}
+	if r.Method == http.MethodGet {
+		w = &countingDownload{ResponseWriter: w, ctx: r.Context(), s: s, shareID: sh.ID}
+	}
+	s.proxyReadFile(r.Context(), w, r, ac, p, writeShareError)
+}
+
+var errDownloadLimit = fmt.Errorf("download limit reached")
+
+// countingDownload counts a share download when the response it carries turns out to serve the
+// content from its start, and answers 410 instead if the limit was reached meanwhile.
+type countingDownload struct {
+	http.ResponseWriter
+	ctx     context.Context
+	s       *Server
+	shareID string
+	wrote   bool
+	refused bool
+}
+
+func (d *countingDownload) WriteHeader(code int) {
+	if d.wrote {
+		return
+	}
+	d.wrote = true
+	h := d.Header()
+	// A multipart (multi-range) response has no Content-Range and may cover it all, so it counts.
+	partial := code == http.StatusPartialContent
+	if cr := h.Get("Content-Range"); partial && cr != "" && !strings.HasPrefix(cr, "bytes 0-") || code != http.StatusOK && !partial {
+		d.ResponseWriter.WriteHeader(code)
+		return
+	}
+	// The condition makes concurrent downloads race for the last ones.
+	result, err := d.s.pool.Exec(d.ctx,
+		`UPDATE shares SET downloads = downloads + 1 WHERE id::text = $1 AND (max_downloads IS NULL OR downloads < max_downloads)`, d.shareID)
+	if err == nil && result.RowsAffected() > 0 {
+		d.ResponseWriter.WriteHeader(code)
+		return
+	}
+	d.refused = true
+	for _, k := range []string{"Content-Length", "Content-Range", "Content-Disposition", "Content-Encoding", "ETag", "Last-Modified", "Accept-Ranges"} {
+		h.Del(k)
+	}
+	if err != nil {
+		writeJSONError(d.ResponseWriter, http.StatusInternalServerError, "internal error")
+		return
+	}
+	writeJSONError(d.ResponseWriter, http.StatusGone, "download limit reached")
+}
+
+func (d *countingDownload) Write(b []byte) (int, error) {
+	if !d.wrote {
+		d.WriteHeader(http.StatusOK)
+	}
+	if d.refused {
+		return 0, errDownloadLimit
+	}
+	return d.ResponseWriter.Write(b)
+}
+
+func (d *countingDownload) Unwrap() http.ResponseWriter {
+	return d.ResponseWriter
+}
+
+// ShareUpload puts a new file into the folder of a drop share. Existing files are never
+// replaced. PUT /s/:token/upload?name=
+func (s *Server) ShareUpload(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		writeJSONError(w, http.StatusBadRequest, "invalid file name")
+		return
+	}
+	_, p, ac, ok := s.openShareTarget(w, r, shareModeDrop, name)
+	if !ok {
+		return
+	}
+	_, err := s.getMeta(r.Context(), ac, p)
+	if err == nil {
+		writeJSONError(w, http.StatusConflict, "file exists")
+		return
+	}
+	var agentErr *AgentError
+	if !errors.As(err, &agentErr) {
+		writeShareError(w, err)
+		return
+	}
+	// The check above saves sending a doomed upload; the agent checks again as it moves the
+	// file into place, so a file created meanwhile is not replaced either.
+	if err := ac.CreateFrom(r.Context(), p, r.Body); err != nil {
+		if isExistsError(err) {
+			writeJSONError(w, http.StatusConflict, "file exists")
+			return
+		}
+		writeShareError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// openShareTarget opens the share for a request that needs mode, resolves sub within it and
+// finds its agent.
+func (s *Server) openShareTarget(w http.ResponseWriter, r *http.Request, mode, sub string) (*share, string, *AgentConn, bool) {
+	sh, ok := s.openShare(w, r, true)
+	if !ok {
+		return nil, "", nil, false
+	}
+	if sh.Mode != mode {
+		msg := "read-only share"
+		if sh.Mode == shareModeDrop {
+			msg = "upload-only share"
+		}
+		writeJSONError(w, http.StatusForbidden, msg)
+		return nil, "", nil, false
+	}
+	p, ok := sh.target(sub)
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "path outside the share")
+		return nil, "", nil, false
+	}
+	ac := s.hub.Get(sh.AgentID)
+	if ac == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "agent not connected")
+		return nil, "", nil, false
+	}
+	return sh, p, ac, true
+}
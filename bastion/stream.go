@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"blackbox/pkg"
+
+	"github.com/google/uuid"
+)
+
+// streamIdleTimeout bounds the wait for the next message of a chunked transfer.
+// Streams are not bounded by proxyTimeout, so large files take as long as they need.
+const streamIdleTimeout = 30 * time.Second
+
+// streamResultBuffer is how many partial results (hash_entries, search_matches) are held for
+// a slow consumer. They are not flow controlled, so a request whose consumer falls further
+// behind is cancelled rather than stalling readLoop.
+const streamResultBuffer = 256
+
+var errStreamIdle = fmt.Errorf("agent stream timed out")
+var errStreamOverflow = fmt.Errorf("agent stream: consumer too slow")
+var errReadSource = fmt.Errorf("failed to read source")
+
+// streamMsg is a decoded stream_chunk, stream_ack or stream_close message.
+type streamMsg struct {
+	Type  string
+	Seq   int64
+	Data  []byte
+	Error string
+}
+
+// agentStream receives the control messages of one chunked transfer.
+type agentStream struct {
+	ac *AgentConn
+	id string
+	ch chan streamMsg
+	// overflow is closed when a message found ch full and was dropped.
+	overflow     chan struct{}
+	overflowOnce sync.Once
+}
+
+func (ac *AgentConn) openStream(requestID string) (*agentStream, error) {
+	if err := ac.require(pkg.TypeStreamOpen); err != nil {
+		return nil, err
+	}
+	return ac.addStream(requestID, pkg.StreamWindow+4)
+}
+
+// addStream registers a stream for requestID that buffers up to size messages.
+func (ac *AgentConn) addStream(requestID string, size int) (*agentStream, error) {
+	st := &agentStream{
+		ac:       ac,
+		id:       requestID,
+		ch:       make(chan streamMsg, size),
+		overflow: make(chan struct{}),
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ac.streams == nil {
+		return nil, errConnClosed
+	}
+	ac.streams[requestID] = st
+	return st, nil
+}
+
+func (st *agentStream) close() {
+	st.ac.mu.Lock()
+	if st.ac.streams != nil {
+		delete(st.ac.streams, st.id)
+	}
+	st.ac.mu.Unlock()
+}
+
+// recv waits for the next stream message, the context, the connection, or the idle timeout.
+func (st *agentStream) recv(ctx context.Context) (streamMsg, error) {
+	timer := time.NewTimer(streamIdleTimeout)
+	defer timer.Stop()
+	select {
+	case m := <-st.ch:
+		return m, nil
+	case <-st.overflow:
+		return streamMsg{}, errStreamOverflow
+	case <-ctx.Done():
+		return streamMsg{}, ctx.Err()
+	case <-st.ac.done:
+		return streamMsg{}, errConnClosed
+	case <-timer.C:
+		return streamMsg{}, errStreamIdle
+	}
+}
+
+// routeStream delivers a stream control message (JSON) read by readLoop.
+func (ac *AgentConn) routeStream(typ, requestID string, data []byte) {
+	var m struct {
+		Seq   int64  `json:"seq"`
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(data, &m) != nil {
+		return
+	}
+	ac.deliver(requestID, streamMsg{Type: typ, Seq: m.Seq, Error: m.Error})
+}
+
+// requestStream is Request for message types that send partial results (hash_entries,
+// search_matches) under the same request_id before the final response. readLoop delivers
+// them in order, ahead of the response; fn is called with each one. An error from fn
+// cancels the request, as does fn falling more than streamResultBuffer results behind.
+func (ac *AgentConn) requestStream(ctx context.Context, requestID string, req interface{}, fn func(json.RawMessage) error) (json.RawMessage, error) {
+	st, err := ac.addStream(requestID, streamResultBuffer)
+	if err != nil {
+		return nil, err
+	}
+	defer st.close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		data json.RawMessage
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		data, err := ac.Request(ctx, requestID, req)
+		done <- result{data, err}
+	}()
+	for {
+		select {
+		case m := <-st.ch:
+			if err := fn(m.Data); err != nil {
+				return nil, err
+			}
+		case <-st.overflow:
+			return nil, errStreamOverflow
+		case res := <-done:
+			if res.err != nil {
+				return nil, res.err
+			}
+			for len(st.ch) > 0 {
+				if err := fn((<-st.ch).Data); err != nil {
+					return nil, err
+				}
+			}
+			return res.data, nil
+		}
+	}
+}
+
+// routeFrame delivers a binary frame read by readLoop.
+func (ac *AgentConn) routeFrame(data []byte) {
+	f, err := pkg.DecodeFrame(data)
+	if err != nil {
+		log.Printf("agent %s: %v", ac.AgentID, err)
+		return
+	}
+	if f.Type == pkg.FrameStreamChunk {
+		ac.deliver(f.RequestID, streamMsg{Type: pkg.TypeStreamChunk, Seq: f.Seq, Data: f.Payload})
+	}
+}
+
+// deliver hands msg to its stream, if still open. It never blocks, since it runs on
+// readLoop: chunks are bounded by the stream window, and a stream whose buffer is full
+// anyway is failed instead of waited on.
+func (ac *AgentConn) deliver(requestID string, msg streamMsg) {
+	ac.mu.Lock()
+	st := ac.streams[requestID]
+	ac.mu.Unlock()
+	if st == nil {
+		return
+	}
+	select {
+	case st.ch <- msg:
+	default:
+		st.overflowOnce.Do(func() { close(st.overflow) })
+	}
+}
+
+// streamReader is an io.ReadCloser over a chunked read from the agent.
+type streamReader struct {
+	ctx      context.Context
+	st       *agentStream
+	buf      []byte
+	seq      int64
+	err      error
+	finished bool
+}
+
+// OpenRead starts a chunked read of path on the agent. size 0 reads to end of file.
+// The first message is awaited before returning so that agent errors (bad path, missing
+// file) surface before the caller writes any response.
+func (ac *AgentConn) OpenRead(ctx context.Context, path string, offset, size int64) (io.ReadCloser, error) {
+	reqID := uuid.New().String()
+	st, err := ac.openStream(reqID)
+	if err != nil {
+		return nil, err
+	}
+	req := pkg.StreamOpen{Type: pkg.TypeStreamOpen, RequestID: reqID, Op: pkg.StreamOpRead, Path: path, Offset: offset, Size: size}
+	if err := ac.send(req); err != nil {
+		st.close()
+		return nil, err
+	}
+	r := &streamReader{ctx: ctx, st: st}
+	if r.err = r.next(); r.err != nil && r.err != io.EOF {
+		err := r.err
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *streamReader) next() error {
+	m, err := r.st.recv(r.ctx)
+	if err != nil {
+		return err
+	}
+	switch m.Type {
+	case pkg.TypeStreamChunk:
+		if m.Seq != r.seq+1 {
+			return fmt.Errorf("agent stream: out of order chunk %d", m.Seq)
+		}
+		r.seq = m.Seq
+		r.buf = m.Data
+		return r.st.ac.send(pkg.StreamAck{Type: pkg.TypeStreamAck, RequestID: r.st.id, Seq: r.seq})
+	case pkg.TypeStreamClose:
+		r.finished = true
+		if m.Error != "" {
+			return &AgentError{Msg: m.Error}
+		}
+		if m.Seq != r.seq {
+			return io.ErrUnexpectedEOF
+		}
+		return io.EOF
+	}
+	return nil
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.next()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Close releases the stream, telling the agent to stop if the read did not finish.
+func (r *streamReader) Close() error {
+	if !r.finished {
+		_ = r.st.ac.send(pkg.StreamClose{Type: pkg.TypeStreamClose, RequestID: r.st.id, Seq: r.seq, Error: "aborted"})
+	}
+	r.st.close()
+	return nil
+}
+
+// WriteFrom streams src to path on the agent, keeping at most StreamWindow chunks in flight.
+// It returns once the agent has atomically replaced the file. If sha256 (hex) is set the
+// agent verifies the content against it and leaves the old file in place on mismatch.
+func (ac *AgentConn) WriteFrom(ctx context.Context, path string, src io.Reader, sha256 string) error {
+	if sha256 != "" && !ac.Supports(pkg.CapSHA256) {
+		return &unsupportedError{What: "checksum verification"}
+	}
+	return ac.writeStream(ctx, pkg.StreamOpen{Op: pkg.StreamOpWrite, Path: path}, src, sha256)
+}
+
+// CreateFrom is WriteFrom for a file that must not exist yet: if path exists, before or
+// when the agent moves the file into place, it fails with an AgentError for which
+// isExistsError is true.
+func (ac *AgentConn) CreateFrom(ctx context.Context, path string, src io.Reader) error {
+	if !ac.Supports(pkg.CapNoReplace) {
+		return &unsupportedError{What: "exclusive create"}
+	}
+	return ac.writeStream(ctx, pkg.StreamOpen{Op: pkg.StreamOpWrite, Path: path, NoReplace: true}, src, "")
+}
+
+// isExistsError reports whether err is the agent refusing a NoReplace write.
+func isExistsError(err error) bool {
+	var agentErr *AgentError
+	return errors.As(err, &agentErr) && agentErr.Msg == pkg.StreamErrExists
+}
+
+// AppendUpload streams src into the partial file of a resumable upload, starting at offset.
+func (ac *AgentConn) AppendUpload(ctx context.Context, path, uploadID string, offset int64, src io.Reader) error {
+	if !ac.Supports(pkg.CapUpload) {
+		return &unsupportedError{What: "resumable uploads"}
+	}
+	return ac.writeStream(ctx, pkg.StreamOpen{Op: pkg.StreamOpWrite, Path: path, Offset: offset, UploadID: uploadID}, src, "")
+}
+
+// writeStream runs a write stream opened with req (Type and RequestID are filled in).
+// sha256 is passed to the agent with the final stream_close. Until then, any failure aborts
+// the stream on the agent, which would otherwise hold its temp file open.
+func (ac *AgentConn) writeStream(ctx context.Context, req pkg.StreamOpen, src io.Reader, sha256 string) (err error) {
+	reqID := uuid.New().String()
+	st, err := ac.openStream(reqID)
+	if err != nil {
+		return err
+	}
+	defer st.close()
+	req.Type = pkg.TypeStreamOpen
+	req.RequestID = reqID
+	if err := ac.send(req); err != nil {
+		return err
+	}
+	var seq, acked int64
+	closed := false // the agent ended the stream, or was sent its final stream_close
+	defer func() {
+		if err != nil && !closed {
+			_ = ac.send(pkg.StreamClose{Type: pkg.TypeStreamClose, RequestID: reqID, Seq: seq, Error: "aborted"})
+		}
+	}()
+	m, err := st.recv(ctx)
+	if err != nil {
+		return err
+	}
+	if m.Type == pkg.TypeStreamClose {
+		closed = true
+		return streamCloseError(m)
+	}
+	// Source data is read straight into the frame buffer after the header.
+	hdrLen := pkg.FrameHeaderLen(reqID)
+	buf := make([]byte, hdrLen+pkg.StreamChunkSize)
+	for {
+		n, rerr := io.ReadFull(src, buf[hdrLen:])
+		if n > 0 {
+			// Pick up acks (or an early failure); block only while the window is full.
+			for {
+				var m streamMsg
+				if seq-acked >= pkg.StreamWindow {
+					if m, err = st.recv(ctx); err != nil {
+						return err
+					}
+				} else {
+					select {
+					case m = <-st.ch:
+					default:
+					}
+				}
+				if m.Type == "" {
+					break
+				}
+				if m.Type == pkg.TypeStreamClose {
+					closed = true
+					return streamCloseError(m)
+				}
+				if m.Type == pkg.TypeStreamAck && m.Seq > acked {
+					acked = m.Seq
+				}
+			}
+			seq++
+			if _, err := pkg.AppendFrameHeader(buf[:0], pkg.FrameStreamChunk, reqID, seq); err != nil {
+				return err
+			}
+			if err := ac.writeBinary(buf[:hdrLen+n]); err != nil {
+				return err
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return fmt.Errorf("%w: %v", errReadSource, rerr)
+		}
+	}
+	closed = true
+	if err := ac.send(pkg.StreamClose{Type: pkg.TypeStreamClose, RequestID: reqID, Seq: seq, SHA256: sha256}); err != nil {
+		return err
+	}
+	for {
+		m, err := st.recv(ctx)
+		if err != nil {
+			return err
+		}
+		if m.Type == pkg.TypeStreamClose {
+			if m.Error != "" {
+				return &AgentError{Msg: m.Error}
+			}
+			return nil
+		}
+	}
+}
+
+func streamCloseError(m streamMsg) error {
+	if m.Error != "" {
+		return &AgentError{Msg: m.Error}
+	}
+	return &AgentError{Msg: "stream closed by agent"}
+}
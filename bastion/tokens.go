@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// API tokens are long-lived credentials for scripts, created in the console and sent as
+// "Authorization: Bearer bbx_...". A token acts as its user, optionally limited to reading
+// and to some agents and paths. Only a hash is stored, so a token is shown once.
+
+const (
+	apiTokenPrefix  = "bbx_"
+	maxAPITokenName = 100
+)
+
+// tokenScope limits a scoped token to path (and below) on an agent.
+type tokenScope struct {
+	AgentID string `json:"agent_id"`
+	Path    string `json:"path"`
+}
+
+// apiToken is the API token a request was made with.
+type apiToken struct {
+	ID       string
+	ReadOnly bool
+	Scoped   bool
+	Scopes   []tokenScope
+}
+
+// restrict limits a, what the token's user may do on the agent, to what the token allows.
+// A nil token allows everything.
+func (t *apiToken) restrict(agentID string, a access) access {
+	if t == nil {
+		return a
+	}
+	a.readOnly = t.ReadOnly
+	if !t.Scoped {
+		return a
+	}
+	limited := access{readOnly: t.ReadOnly}
+	for _, sc := range t.Scopes {
+		if sc.AgentID != agentID {
+			continue
+		}
+		if a.all {
+			limited.grants = append(limited.grants, grant{Path: sc.Path, Level: permAdmin})
+			continue
+		}
+		for _, g := range a.grants {
+			switch {
+			case pathWithin(sc.Path, g.Path):
+				limited.grants = append(limited.grants, grant{Path: sc.Path, Level: g.Level})
+			case pathWithin(g.Path, sc.Path):
+				limited.grants = append(limited.grants, g)
+			}
+		}
+	}
+	return limited
+}
+
+// siteAdmin reports whether the request may act as a site admin. Read-only and scoped API
+// tokens of admins may not.
+func (c *SessionClaims) siteAdmin() bool {
+	return c.Admin && !c.limited()
+}
+
+// limited reports whether the request was made with a read-only or scoped API token.
+func (c *SessionClaims) limited() bool {
+	return c.Token != nil && (c.Token.ReadOnly || c.Token.Scoped)
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// useAPIToken returns the claims of the user behind an API token, or errNoSession if the
+// token is unknown or expired. At most every sessionTouchInterval it records the use.
+func (s *Server) useAPIToken(r *http.Request, token string) (*SessionClaims, error) {
+	claims := &SessionClaims{Token: &apiToken{}}
+	t := claims.Token
+	var lastUsed *time.Time
+	err := s.pool.QueryRow(r.Context(),
+		`SELECT t.id::text, t.user_id::text, u.username, u.is_admin, t.read_only, t.scoped, t.last_used_at
+		 FROM api_tokens t JOIN users u ON u.id = t.user_id
+		 WHERE t.token_hash = $1 AND (t.expires_at IS NULL OR t.expires_at > now())`,
+		hashAPIToken(token)).Scan(&t.ID, &claims.UserID, &claims.Username, &claims.Admin, &t.ReadOnly, &t.Scoped, &lastUsed)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errNoSession
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t.Scoped {
+		scopes, err := s.tokenScopes(r.Context(), []string{t.ID})
+		if err != nil {
+			return nil, err
+		}
+		t.Scopes = scopes[t.ID]
+	}
+	if lastUsed == nil || time.Since(*lastUsed) >= sessionTouchInterval {
+		_, err := s.pool.Exec(r.Context(), `UPDATE api_tokens SET last_used_at = now(), last_used_addr = $2 WHERE id::text = $1`, t.ID, remoteIP(r))
+		if err != nil {
+			log.Printf("tokens: touch: %v", err)
+		}
+	}
+	return claims, nil
+}
+
+// tokenScopes loads the scopes of the tokens, by token ID.
+func (s *Server) tokenScopes(ctx context.Context, ids []string) (map[string][]tokenScope, error) {
+	rows, err := s.pool.Query(ctx,
+		`SELECT token_id::text, agent_id::text, path FROM api_token_scopes WHERE token_id::text = ANY($1) ORDER BY agent_id, path`, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	m := make(map[string][]tokenScope)
+	for rows.Next() {
+		var id string
+		var sc tokenScope
+		if err := rows.Scan(&id, &sc.AgentID, &sc.Path); err != nil {
+			return nil, err
+		}
+		m[id] = append(m[id], sc)
+	}
+	return m, rows.Err()
+}
+
+// SessionOnly refuses requests made with an API token, for routes that manage the account
+// itself. Wrap inside AuthMiddleware.
+func (s *Server) SessionOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c := ClaimsFromContext(r.Context()); c == nil || c.Token != nil {
+			writeJSONError(w, http.StatusForbidden, "not allowed with an API token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// tokenInfo is a row of the api_tokens table as listed to its user.
+type tokenInfo struct {
+	ID           string       `json:"id"`
+	Name         string       `json:"name"`
+	Prefix       string       `json:"prefix"` // start of the token
+	ReadOnly     bool         `json:"read_only"`
+	Scoped       bool         `json:"scoped"`
+	Scopes       []tokenScope `json:"scopes"` // if scoped, the only agents and paths it reaches
+	ExpiresAt    *time.Time   `json:"expires_at,omitempty"`
+	LastUsedAt   *time.Time   `json:"last_used_at,omitempty"`
+	LastUsedAddr string       `json:"last_used_addr,omitempty"`
+	CreatedAt    time.Time    `json:"created_at"`
+	Token        string       `json:"token,omitempty"` // only when created
+}
+
+// ListAPITokens lists the user's API tokens, newest first. GET /api/tokens
+func (s *Server) ListAPITokens(w http.ResponseWriter, r *http.Request) {
+	claims := ClaimsFromContext(r.Context())
+	rows, err := s.pool.Query(r.Context(),
+		`SELECT id::text, name, prefix, read_only, scoped, expires_at, last_used_at, last_used_addr, created_at
+		 FROM api_tokens WHERE user_id::text = $1 ORDER BY created_at DESC`, claims.UserID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	defer rows.Close()
+	list := []*tokenInfo{}
+	var ids []string
+	for rows.Next() {
+		var t tokenInfo
+		if err := rows.Scan(&t.ID, &t.Name, &t.Prefix, &t.ReadOnly, &t.Scoped, &t.ExpiresAt, &t.LastUsedAt, &t.LastUsedAddr, &t.CreatedAt); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		list = append(list, &t)
+		ids = append(ids, t.ID)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	scopes, err := s.tokenScopes(r.Context(), ids)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	for _, t := range list {
+		t.Scopes = scopes[t.ID]
+		if t.Scopes == nil {
+			t.Scopes = []tokenScope{}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(list)
+}
+
+// CreateAPIToken creates an API token for the user and returns it, the only time it is shown.
+// Without scopes it reaches every agent the user can.
+// POST /api/tokens {"name","read_only","scopes":[{"agent_id","path"}],"expires_at"}
+func (s *Server) CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	claims := ClaimsFromContext(r.Context())
+	var req struct {
+		Name      string       `json:"name"`
+		ReadOnly  bool         `json:"read_only"`
+		Scopes    []tokenScope `json:"scopes"`
+		ExpiresAt *time.Time   `json:"expires_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad request")
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	switch {
+	case req.Name == "" || len(req.Name) > maxAPITokenName:
+		writeJSONError(w, http.StatusBadRequest, "name required (at most 100 characters)")
+		return
+	case req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()):
+		writeJSONError(w, http.StatusBadRequest, "expires_at must be in the future")
+		return
+	}
+	t := &tokenInfo{Name: req.Name, ReadOnly: req.ReadOnly, Scoped: len(req.Scopes) > 0, Scopes: []tokenScope{}, ExpiresAt: req.ExpiresAt}
+	seen := make(map[tokenScope]bool)
+	for _, sc := range req.Scopes {
+		if strings.Contains(sc.Path, `\`) {
+			writeJSONError(w, http.StatusBadRequest, "path must use forward slashes")
+			return
+		}
+		sc.Path = indexPath(sc.Path)
+		acc, err := s.agentAccess(r.Context(), claims, sc.AgentID)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		if !acc.visible() {
+			writeJSONError(w, http.StatusBadRequest, "no such agent: "+sc.AgentID)
+			return
+		}
+		if !seen[sc] {
+			seen[sc] = true
+			t.Scopes = append(t.Scopes, sc)
+		}
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	t.Token = apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	t.Prefix = t.Token[:len(apiTokenPrefix)+8]
+	err := pgx.BeginFunc(r.Context(), s.pool, func(tx pgx.Tx) error {
+		err := tx.QueryRow(r.Context(),
+			`INSERT INTO api_tokens (user_id, name, token_hash, prefix, read_only, scoped, expires_at)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id::text, created_at`,
+			claims.UserID, t.Name, hashAPIToken(t.Token), t.Prefix, t.ReadOnly, t.Scoped, t.ExpiresAt).Scan(&t.ID, &t.CreatedAt)
+		if err != nil {
+			return err
+		}
+		batch := &pgx.Batch{}
+		for _, sc := range t.Scopes {
+			batch.Queue(`INSERT INTO api_token_scopes (token_id, agent_id, path) VALUES ($1, $2, $3)`, t.ID, sc.AgentID, sc.Path)
+		}
+		return tx.SendBatch(r.Context(), batch).Close()
+	})
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && (pgErr.Code == "23503" || pgErr.Code == "22P02") {
+		// A site admin sees every agent ID as visible; the agent must still exist.
+		writeJSONError(w, http.StatusBadRequest, "no such agent")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(t)
+}
+
+// DeleteAPIToken revokes one of the user's API tokens. DELETE /api/tokens/:id
+func (s *Server) DeleteAPIToken(w http.ResponseWriter, r *http.Request) {
+	claims := ClaimsFromContext(r.Context())
+	result, err := s.pool.Exec(r.Context(), `DELETE FROM api_tokens WHERE id::text = $1 AND user_id::text = $2`, r.PathValue("id"), claims.UserID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if result.RowsAffected() == 0 {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
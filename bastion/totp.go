@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+// Two-factor login with TOTP (RFC 6238: HMAC-SHA1, 6 digits, 30 s steps), as produced by
+// common authenticator apps.
+const (
+	totpIssuer          = "blackbox"
+	totpPeriod          = 30
+	totpDigits          = 6
+	totpSkew            = 1               // steps of clock drift accepted either way
+	totpChallengeExpiry = 5 * time.Minute // time between the password and the code
+	totpMaxFailures     = 5               // wrong codes per user per totpChallengeExpiry
+	recoveryCodeCount   = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a random 160-bit secret, base32 encoded.
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpCode returns the code for time step step (RFC 4226 dynamic truncation).
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n%1_000_000)
+}
+
+// totpMatch returns the time step code is valid for at now. Steps up to last have been used
+// already and are refused, so a code cannot be replayed.
+func totpMatch(secret, code string, now time.Time, last int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	cur := now.Unix() / totpPeriod
+	for step := cur - totpSkew; step <= cur+totpSkew; step++ {
+		if step > last && subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI is the otpauth:// URI authenticator apps import, usually from a QR code.
+func totpURI(username, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+username) + "?" + v.Encode()
+}
+
+// newRecoveryCodes returns one-time codes like "k3x9q-p2mzd" and their hashes. The codes are
+// random enough (50 bits) that a plain SHA-256 is a safe way to store them.
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz234567"
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		for j := range b {
+			b[j] = alphabet[b[j]%32]
+		}
+		code := string(b[:5]) + "-" + string(b[5:])
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// totpChallengeKey signs challenge tokens. It differs from the session key, so a challenge
+// can never pass as a session.
+func totpChallengeKey(jwtSecret string) []byte {
+	return []byte("totp\x00" + jwtSecret)
+}
+
+// issueTOTPChallenge returns a short-lived token proving that userID gave the right password.
+func issueTOTPChallenge(userID, jwtSecret string) (string, error) {
+	claims := jwt.RegisteredClaims{
+		Subject:   userID,
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(totpChallengeExpiry)),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(totpChallengeKey(jwtSecret))
+}
+
+// validateTOTPChallenge returns the user ID of a valid challenge token.
+func validateTOTPChallenge(token, jwtSecret string) (string, error) {
+	var claims jwt.RegisteredClaims
+	t, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return totpChallengeKey(jwtSecret), nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if !t.Valid || claims.Subject == "" {
+		return "", jwt.ErrTokenInvalidClaims
+	}
+	return claims.Subject, nil
+}
+
+// failureLimiter counts failed attempts per key over a fixed window.
+type failureLimiter struct {
+	max    int
+	window time.Duration
+	mu     sync.Mutex
+	fails  map[string]failureCount
+}
+
+type failureCount struct {
+	n     int
+	since time.Time
+}
+
+func newFailureLimiter(max int, window time.Duration) *failureLimiter {
+	return &failureLimiter{max: max, window: window, fails: make(map[string]failureCount)}
+}
+
+// allowed reports whether key has attempts left.
+func (l *failureLimiter) allowed(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.fails[key]
+	return !ok || time.Since(f.since) >= l.window || f.n < l.max
+}
+
+func (l *failureLimiter) fail(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, f := range l.fails {
+		if time.Since(f.since) >= l.window {
+			delete(l.fails, k)
+		}
+	}
+	f := l.fails[key]
+	if f.n == 0 {
+		f.since = time.Now()
+	}
+	f.n++
+	l.fails[key] = f
+}
+
+func (l *failureLimiter) reset(key string) {
+	l.mu.Lock()
+	delete(l.fails, key)
+	l.mu.Unlock()
+}
+
+// checkSecondFactor accepts a current TOTP code or an unused recovery code for user, using it
+// up. Callers check the limiter first.
+func (s *Server) checkSecondFactor(ctx context.Context, user *User, code string) (bool, error) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) == totpDigits {
+		step, ok := totpMatch(user.TOTPSecret, code, time.Now(), user.TOTPLastStep)
+		if !ok {
+			return false, nil
+		}
+		// The condition makes concurrent logins with the same code race for a single use.
+		result, err := s.pool.Exec(ctx, `UPDATE users SET totp_last_step = $2 WHERE id::text = $1 AND totp_last_step < $2`, user.ID, step)
+		if err != nil {
+			return false, err
+		}
+		return result.RowsAffected() == 1, nil
+	}
+	result, err := s.pool.Exec(ctx,
+		`UPDATE recovery_codes SET used_at = now() WHERE user_id::text = $1 AND code_hash = $2 AND used_at IS NULL`,
+		user.ID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() == 1, nil
+}
+
+// LoginTOTP is the second login step for users with 2FA: it trades the challenge returned
+// by Login and a TOTP or recovery code for a session.
+// POST /api/login/totp {"challenge", "code"}
+func (s *Server) LoginTOTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad request")
+		return
+	}
+	userID, err := validateTOTPChallenge(req.Challenge, s.cfg.JWTSecret)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "login expired; enter your password again")
+		return
+	}
+	if !s.totpFails.allowed(userID) {
+		writeJSONError(w, http.StatusTooManyRequests, "too many wrong codes; try again later")
+		return
+	}
+	user, err := GetUserByID(r.Context(), s.pool, userID)
+	if err != nil || user.TOTPSecret == "" {
+		writeJSONError(w, http.StatusUnauthorized, "login expired; enter your password again")
+		return
+	}
+	ok, err := s.checkSecondFactor(r.Context(), user, req.Code)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if !ok {
+		s.totpFails.fail(userID)
+		writeJSONError(w, http.StatusUnauthorized, "invalid code")
+		return
+	}
+	s.totpFails.reset(userID)
+	s.startSession(w, r, user)
+}
+
+// TOTPStatus reports whether 2FA is on. GET /api/2fa
+func (s *Server) TOTPStatus(w http.ResponseWriter, r *http.Request) {
+	claims := ClaimsFromContext(r.Context())
+	var enabled bool
+	var left int
+	err := s.pool.QueryRow(r.Context(), `
+		SELECT totp_secret IS NOT NULL, (SELECT count(*) FROM recovery_codes c WHERE c.user_id = u.id AND c.used_at IS NULL)
+		FROM users u WHERE id::text = $1`, claims.UserID).Scan(&enabled, &left)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"enabled": enabled, "recovery_codes_left": left})
+}
+
+// SetupTOTP starts enrollment: it generates a secret and returns it with its otpauth:// URI
+// (the QR code payload). 2FA is not on until EnableTOTP confirms a code from it.
+// POST /api/2fa/setup
+func (s *Server) SetupTOTP(w http.ResponseWriter, r *http.Request) {
+	claims := ClaimsFromContext(r.Context())
+	secret, err := newTOTPSecret()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	result, err := s.pool.Exec(r.Context(),
+		`UPDATE users SET totp_pending = $2 WHERE id::text = $1 AND totp_secret IS NULL`, claims.UserID, secret)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if result.RowsAffected() == 0 {
+		writeJSONError(w, http.StatusConflict, "2fa already enabled")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"secret":      secret,
+		"otpauth_uri": totpURI(claims.Username, secret),
+	})
+}
+
+// EnableTOTP turns 2FA on once code matches the secret from SetupTOTP, and returns the
+// recovery codes. They are shown this once; only their hashes are kept.
+// POST /api/2fa/enable {"code"}
+func (s *Server) EnableTOTP(w http.ResponseWriter, r *http.Request) {
+	claims := ClaimsFromContext(r.Context())
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad request")
+		return
+	}
+	var pending *string
+	err := s.pool.QueryRow(r.Context(), `SELECT totp_pending FROM users WHERE id::text = $1 AND totp_secret IS NULL`, claims.UserID).Scan(&pending)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSONError(w, http.StatusConflict, "2fa already enabled")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if pending == nil {
+		writeJSONError(w, http.StatusBadRequest, "start with POST /api/2fa/setup")
+		return
+	}
+	step, ok := totpMatch(*pending, strings.TrimSpace(req.Code), time.Now(), 0)
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "invalid code")
+		return
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	b := &pgx.Batch{}
+	b.Queue(`UPDATE users SET totp_secret = totp_pending, totp_pending = NULL, totp_last_step = $2 WHERE id::text = $1`, claims.UserID, step)
+	b.Queue(`DELETE FROM recovery_codes WHERE user_id::text = $1`, claims.UserID)
+	for _, h := range hashes {
+		b.Queue(`INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)`, claims.UserID, h)
+	}
+	if err := s.inTx(r.Context(), b); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+// DisableTOTP turns 2FA off after checking the password again.
+// POST /api/2fa/disable {"password"}
+func (s *Server) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	claims := ClaimsFromContext(r.Context())
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad request")
+		return
+	}
+	user, err := GetUserByID(r.Context(), s.pool, claims.UserID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if !CheckPassword(user.PasswordHash, req.Password) {
+		writeJSONError(w, http.StatusForbidden, "wrong password")
+		return
+	}
+	b := &pgx.Batch{}
+	b.Queue(`UPDATE users SET totp_secret = NULL, totp_pending = NULL, totp_last_step = 0 WHERE id::text = $1`, claims.UserID)
+	b.Queue(`DELETE FROM recovery_codes WHERE user_id::text = $1`, claims.UserID)
+	if err := s.inTx(r.Context(), b); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// inTx runs the batch in one transaction.
+func (s *Server) inTx(ctx context.Context, b *pgx.Batch) error {
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		return tx.SendBatch(ctx, b).Close()
+	})
+}
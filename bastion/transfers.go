@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sync/atomic"
+
+	"blackbox/pkg"
+
+	"github.com/google/uuid"
+)
+
+// CreateTransfer queues a copy or move job between agents. POST /api/transfers
+// {"from_agent","from_path","to_agent","to_path","move","overwrite"}. Replies 202 with the
+// job; poll GET /api/jobs/:id for progress.
+func (s *Server) CreateTransfer(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		FromAgent string `json:"from_agent"`
+		FromPath  string `json:"from_path"`
+		ToAgent   string `json:"to_agent"`
+		ToPath    string `json:"to_path"`
+		Move      bool   `json:"move"`
+		Overwrite bool   `json:"overwrite"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad request")
+		return
+	}
+	kind := jobCopy
+	if req.Move {
+		kind = jobMove
+	}
+	s.startJob(w, r, kind, jobParams{
+		Agent: req.FromAgent, Path: req.FromPath, ToAgent: req.ToAgent, ToPath: req.ToPath, Overwrite: req.Overwrite,
+	})
+}
+
+// checkTransfer validates a copy or move before it is queued.
+func (s *Server) checkTransfer(w http.ResponseWriter, r *http.Request, src *AgentConn, p jobParams) bool {
+	if p.ToAgent == "" || p.ToPath == "" {
+		writeJSONError(w, http.StatusBadRequest, "to_agent and to_path required")
+		return false
+	}
+	dst := s.hub.Get(p.ToAgent)
+	if dst == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "agent not connected")
+		return false
+	}
+	for _, ac := range []*AgentConn{src, dst} {
+		if !ac.Supports(pkg.CapStream) {
+			writeAgentError(w, &unsupportedError{What: "transfers"})
+			return false
+		}
+	}
+	if _, err := s.getMeta(r.Context(), src, p.Path); err != nil {
+		writeAgentError(w, err)
+		return false
+	}
+	if !p.Overwrite {
+		exists, err := s.pathExists(r.Context(), dst, p.ToPath)
+		if err != nil {
+			writeAgentError(w, err)
+			return false
+		}
+		if exists {
+			writeJSONError(w, http.StatusConflict, "destination exists")
+			return false
+		}
+	}
+	return true
+}
+
+// transferItem is one entry to copy, relative to the transfer root ("" is the root itself).
+type transferItem struct {
+	rel   string
+	isDir bool
+	size  int64
+}
+
+// runTransfer executes a copy or move job. File data streams from OpenRead on the source
+// straight into WriteFrom on the destination, so bastion holds at most one stream window
+// per file in memory. A retried job starts over; writes are atomic, so files copied by an
+// earlier attempt are simply replaced.
+func (s *Server) runTransfer(ctx context.Context, run *jobRun) error {
+	p := run.Params
+	src, err := s.jobAgent(p.Agent)
+	if err != nil {
+		return err
+	}
+	dst, err := s.jobAgent(p.ToAgent)
+	if err != nil {
+		return err
+	}
+	move := run.Kind == jobMove
+	// Within one agent, let the agent rename or copy locally.
+	if src == dst && src.Supports(pkg.CapFileOps) {
+		run.set(func() { run.current = p.Path })
+		reqID := uuid.New().String()
+		if move {
+			return agentOp(ctx, src, reqID, pkg.RenameRequest{Type: pkg.TypeRename, RequestID: reqID, From: p.Path, To: p.ToPath, Overwrite: p.Overwrite})
+		}
+		return agentOp(ctx, src, reqID, pkg.CopyRequest{Type: pkg.TypeCopy, RequestID: reqID, From: p.Path, To: p.ToPath, Overwrite: p.Overwrite})
+	}
+	items, err := s.scanTree(ctx, src, p.Path)
+	if err != nil {
+		return err
+	}
+	var files int
+	var total int64
+	for _, it := range items {
+		if !it.isDir {
+			files++
+			total += it.size
+		}
+	}
+	run.bytesDone.Store(0)
+	run.set(func() {
+		run.filesTotal, run.filesDone = files, 0
+		run.bytesTotal = total
+	})
+	for _, it := range items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		from, to := path.Join(p.Path, it.rel), path.Join(p.ToPath, it.rel)
+		run.set(func() { run.current = from })
+		if it.isDir {
+			// Writes create parent directories; mkdir keeps empty ones.
+			if dst.Supports(pkg.CapFileOps) {
+				reqID := uuid.New().String()
+				err := agentOp(ctx, dst, reqID, pkg.MkdirRequest{Type: pkg.TypeMkdir, RequestID: reqID, Path: to})
+				if err != nil && !isAlreadyExists(err) {
+					return err
+				}
+			}
+			continue
+		}
+		if err := transferFile(ctx, run, src, dst, from, to); err != nil {
+			return fmt.Errorf("%s: %w", from, err)
+		}
+		run.set(func() { run.filesDone++ })
+	}
+	if move {
+		run.set(func() { run.current = p.Path })
+		reqID := uuid.New().String()
+		return agentOp(ctx, src, reqID, pkg.DeleteFileRequest{Type: pkg.TypeDeleteFile, RequestID: reqID, Path: p.Path})
+	}
+	return nil
+}
+
+func transferFile(ctx context.Context, run *jobRun, src, dst *AgentConn, from, to string) error {
+	rc, err := src.OpenRead(ctx, from, 0, 0)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	pr := &progressReader{r: rc, n: &run.bytesDone}
+	if err := dst.WriteFrom(ctx, to, pr, ""); err != nil {
+		// Take the partial file back out of the totals; the destination keeps its old content.
+		run.bytesDone.Add(-pr.read)
+		return err
+	}
+	return nil
+}
+
+// scanTree lists the file or directory tree at root on the agent, parents before children.
+func (s *Server) scanTree(ctx context.Context, ac *AgentConn, root string) ([]transferItem, error) {
+	meta, err := s.getMeta(ctx, ac, root)
+	if err != nil {
+		return nil, err
+	}
+	if !meta.IsDir {
+		return []transferItem{{size: meta.Size}}, nil
+	}
+	items := []transferItem{{isDir: true}}
+	err = s.walkTree(ctx, ac, root, func(rel string, e pkg.FileEntry) error {
+		items = append(items, transferItem{rel: rel, isDir: e.IsDir, size: e.Size})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// pathExists reports whether p exists on the agent, by listing its parent directory.
+func (s *Server) pathExists(ctx context.Context, ac *AgentConn, p string) (bool, error) {
+	entries, err := s.listDir(ctx, ac, path.Dir(p))
+	var agentErr *AgentError
+	if errors.As(err, &agentErr) {
+		return false, nil // parent missing; the transfer creates it
+	}
+	if err != nil {
+		return false, err
+	}
+	name := path.Base(p)
+	for _, e := range entries {
+		if e.Name == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func isAlreadyExists(err error) bool {
+	var agentErr *AgentError
+	return errors.As(err, &agentErr) && agentErr.Msg == "already exists"
+}
+
+// progressReader adds the bytes read to a shared counter.
+type progressReader struct {
+	r    io.Reader
+	n    *atomic.Int64
+	read int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	p.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"blackbox/pkg"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Resumable uploads follow the tus 1.0.0 protocol (core, creation, termination and
+// expiration extensions): POST creates a session, HEAD reports the received offset,
+// PATCH appends bytes at that offset and DELETE discards the session. The upload is
+// moved into place on the agent once all bytes have arrived.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+	uploadExpiry  = 24 * time.Hour
+)
+
+type upload struct {
+	ID          string
+	AgentID     string
+	Path        string
+	Length      int64
+	Offset      int64
+	Metadata    string
+	CompletedAt *time.Time
+	ExpiresAt   time.Time
+}
+
+// uploadLocks marks the uploads a PATCH or DELETE is working on, so that two requests never
+// append to (or discard) the same partial file at once.
+type uploadLocks struct {
+	mu   sync.Mutex
+	busy map[string]bool
+}
+
+func newUploadLocks() *uploadLocks {
+	return &uploadLocks{busy: make(map[string]bool)}
+}
+
+// claim marks id busy and reports whether it was free.
+func (l *uploadLocks) claim(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.busy[id] {
+		return false
+	}
+	l.busy[id] = true
+	return true
+}
+
+func (l *uploadLocks) release(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.busy, id)
+}
+
+// claimUpload claims the upload named in the URL for the request, answering 409 if another
+// request holds it. The caller must release it.
+func (s *Server) claimUpload(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id := r.PathValue("uid")
+	if !s.uploadLocks.claim(id) {
+		writeJSONError(w, http.StatusConflict, "upload busy")
+		return "", false
+	}
+	return id, true
+}
+
+// tusPreamble sets Tus-Resumable and rejects clients speaking another tus version.
+func tusPreamble(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if v := r.Header.Get("Tus-Resumable"); v != "" && v != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeJSONError(w, http.StatusPreconditionFailed, "unsupported tus version")
+		return false
+	}
+	return true
+}
+
+// parseUploadMetadata decodes a tus Upload-Metadata header ("key base64value,key2 ...").
+func parseUploadMetadata(h string) map[string]string {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(h, ",") {
+		key, val, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(val)
+		if err != nil {
+			continue
+		}
+		meta[key] = string(b)
+	}
+	return meta
+}
+
+// CreateUpload starts a resumable upload. POST /api/agents/{id}/uploads
+// The destination is ?path=, or metadata "path", or ?dir= / metadata "dir" joined with metadata "filename".
+func (s *Server) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	if !tusPreamble(w, r) {
+		return
+	}
+	agentID := r.PathValue("id")
+	if agentID == "" {
+		writeJSONError(w, http.StatusBadRequest, "agent id required")
+		return
+	}
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		writeJSONError(w, http.StatusBadRequest, "Upload-Defer-Length not supported")
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeJSONError(w, http.StatusBadRequest, "Upload-Length required")
+		return
+	}
+	rawMeta := r.Header.Get("Upload-Metadata")
+	meta := parseUploadMetadata(rawMeta)
+	dest := r.URL.Query().Get("path")
+	if dest == "" {
+		dest = meta["path"]
+	}
+	if dest == "" && meta["filename"] != "" {
+		dir := r.URL.Query().Get("dir")
+		if dir == "" {
+			dir = meta["dir"]
+		}
+		dest = path.Join(dir, path.Base(meta["filename"]))
+	}
+	if dest == "" || path.Clean(dest) == "." {
+		writeJSONError(w, http.StatusBadRequest, "destination path required")
+		return
+	}
+	if v := meta["sha256"]; v != "" {
+		if _, err := validSHA256Hex(v); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if _, ok := s.authorize(w, r, agentID, permWrite, dest); !ok {
+		return
+	}
+	ac := s.hub.Get(agentID)
+	if ac == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "agent not connected")
+		return
+	}
+	if !ac.Supports(pkg.CapUpload) {
+		writeAgentError(w, &unsupportedError{What: "resumable uploads"})
+		return
+	}
+	if meta["sha256"] != "" && !ac.Supports(pkg.CapSHA256) {
+		writeAgentError(w, &unsupportedError{What: "checksum verification"})
+		return
+	}
+	expires := time.Now().Add(uploadExpiry)
+	var id string
+	err = s.pool.QueryRow(r.Context(),
+		`INSERT INTO uploads (agent_id, path, length, metadata, expires_at) VALUES ($1, $2, $3, $4, $5) RETURNING id::text`,
+		agentID, dest, length, rawMeta, expires,
+	).Scan(&id)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if length == 0 {
+		if err := s.commitUpload(r.Context(), ac, &upload{ID: id, Path: dest, Metadata: rawMeta}); err != nil {
+			writeAgentError(w, err)
+			return
+		}
+	}
+	w.Header().Set("Location", "/api/agents/"+agentID+"/uploads/"+id)
+	w.Header().Set("Upload-Expires", expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// UploadOffset reports how much of an upload has arrived. HEAD /api/agents/{id}/uploads/{uid}
+func (s *Server) UploadOffset(w http.ResponseWriter, r *http.Request) {
+	if !tusPreamble(w, r) {
+		return
+	}
+	u, ok := s.loadSettledUpload(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	if u.Metadata != "" {
+		w.Header().Set("Upload-Metadata", u.Metadata)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// UploadStatus returns an upload as JSON, including the received byte range. GET /api/agents/{id}/uploads/{uid}
+func (s *Server) UploadStatus(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.loadSettledUpload(w, r)
+	if !ok {
+		return
+	}
+	received := [][2]int64{}
+	if u.Offset > 0 {
+		received = append(received, [2]int64{0, u.Offset})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":         u.ID,
+		"path":       u.Path,
+		"length":     u.Length,
+		"offset":     u.Offset,
+		"received":   received, // [start, end) byte ranges
+		"completed":  u.CompletedAt != nil,
+		"expires_at": u.ExpiresAt,
+	})
+}
+
+// PatchUpload appends the request body at Upload-Offset. PATCH /api/agents/{id}/uploads/{uid}
+func (s *Server) PatchUpload(w http.ResponseWriter, r *http.Request) {
+	if !tusPreamble(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeJSONError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeJSONError(w, http.StatusBadRequest, "Upload-Offset required")
+		return
+	}
+	id, ok := s.claimUpload(w, r)
+	if !ok {
+		return
+	}
+	defer s.uploadLocks.release(id)
+	u, ok := s.loadUpload(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	if u.CompletedAt != nil || offset != u.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+		writeJSONError(w, http.StatusConflict, "offset mismatch")
+		return
+	}
+	ac := s.hub.Get(u.AgentID)
+	if ac == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "agent not connected")
+		return
+	}
+	body := &countingReader{r: io.LimitReader(r.Body, u.Length-u.Offset)}
+	appendErr := ac.AppendUpload(r.Context(), u.Path, u.ID, u.Offset, body)
+	// The request may be gone by now; record progress regardless.
+	ctx, cancel := context.WithTimeout(context.Background(), proxyTimeout)
+	defer cancel()
+	prev := u.Offset
+	if appendErr == nil {
+		u.Offset += body.n
+	} else if size, err := s.statUpload(ctx, ac, u); err == nil {
+		u.Offset = size
+	}
+	s.saveUploadOffset(ctx, u.ID, prev, u.Offset)
+	if appendErr != nil {
+		writeAgentError(w, appendErr)
+		return
+	}
+	if u.Offset == u.Length {
+		if err := s.finishUpload(ctx, ac, u); err != nil {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+			writeAgentError(w, err)
+			return
+		}
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteUpload discards an upload and its partial file. DELETE /api/agents/{id}/uploads/{uid}
+func (s *Server) DeleteUpload(w http.ResponseWriter, r *http.Request) {
+	if !tusPreamble(w, r) {
+		return
+	}
+	id, ok := s.claimUpload(w, r)
+	if !ok {
+		return
+	}
+	defer s.uploadLocks.release(id)
+	u, ok := s.loadUpload(w, r)
+	if !ok {
+		return
+	}
+	if u.CompletedAt == nil {
+		if ac := s.hub.Get(u.AgentID); ac != nil {
+			if err := s.uploadRequest(r.Context(), ac, pkg.TypeUploadAbort, u, nil); err != nil {
+				writeAgentError(w, err)
+				return
+			}
+		}
+	}
+	if _, err := s.pool.Exec(r.Context(), `DELETE FROM uploads WHERE id::text = $1`, u.ID); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadUpload reads the upload named in the URL and refreshes its offset from the agent
+// when connected. It writes the error response and returns false when not found.
+func (s *Server) loadUpload(w http.ResponseWriter, r *http.Request) (*upload, bool) {
+	agentID, uploadID := r.PathValue("id"), r.PathValue("uid")
+	var u upload
+	err := s.pool.QueryRow(r.Context(),
+		`SELECT id::text, agent_id::text, path, length, upload_offset, metadata, completed_at, expires_at
+		 FROM uploads WHERE id::text = $1 AND agent_id::text = $2`,
+		uploadID, agentID,
+	).Scan(&u.ID, &u.AgentID, &u.Path, &u.Length, &u.Offset, &u.Metadata, &u.CompletedAt, &u.ExpiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return nil, false
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return nil, false
+	}
+	if time.Now().After(u.ExpiresAt) {
+		writeJSONError(w, http.StatusGone, "upload expired")
+		return nil, false
+	}
+	// Whoever may write the destination may resume the upload; access is checked again on
+	// every request, so a revoked grant stops it.
+	if _, ok := s.authorize(w, r, u.AgentID, permWrite, u.Path); !ok {
+		return nil, false
+	}
+	if u.CompletedAt == nil {
+		if ac := s.hub.Get(u.AgentID); ac != nil {
+			ctx, cancel := context.WithTimeout(r.Context(), proxyTimeout)
+			defer cancel()
+			if size, err := s.statUpload(ctx, ac, &u); err == nil && size != u.Offset {
+				s.saveUploadOffset(ctx, u.ID, u.Offset, size)
+				u.Offset = size
+			}
+		}
+	}
+	return &u, true
+}
+
+// saveUploadOffset records that the upload moved from offset prev to offset, unless another
+// request already recorded a different offset since prev was read.
+func (s *Server) saveUploadOffset(ctx context.Context, id string, prev, offset int64) {
+	_, err := s.pool.Exec(ctx, `UPDATE uploads SET upload_offset = $1 WHERE id::text = $2 AND upload_offset = $3`, offset, id, prev)
+	if err != nil {
+		log.Printf("upload %s: save offset: %v", id, err)
+	}
+}
+
+// loadSettledUpload is loadUpload for requests that report on an upload (HEAD, GET). An upload
+// whose bytes have all arrived but whose commit failed in transit is committed first, so that a
+// client checking after an error does not take it for done. That needs the upload's lock; while
+// a PATCH or DELETE holds it, the upload is reported as it is.
+func (s *Server) loadSettledUpload(w http.ResponseWriter, r *http.Request) (*upload, bool) {
+	id := r.PathValue("uid")
+	claimed := s.uploadLocks.claim(id)
+	if claimed {
+		defer s.uploadLocks.release(id)
+	}
+	u, ok := s.loadUpload(w, r)
+	if !ok || !claimed || u.CompletedAt != nil || u.Offset != u.Length {
+		return u, ok
+	}
+	ac := s.hub.Get(u.AgentID)
+	if ac == nil {
+		return u, true
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), proxyTimeout)
+	defer cancel()
+	// The agent is authoritative: commit only if it holds every byte.
+	if size, err := s.statUpload(ctx, ac, u); err != nil || size != u.Length {
+		return u, true
+	}
+	if err := s.finishUpload(ctx, ac, u); err != nil {
+		log.Printf("upload %s: commit: %v", u.ID, err)
+		return u, true
+	}
+	now := time.Now()
+	u.CompletedAt = &now
+	return u, true
+}
+
+// finishUpload commits u once all of it has arrived. If the agent refuses (checksum mismatch,
+// destination not writable), the received bytes are discarded and u goes back to offset 0, so
+// the client can send it again; a failure in transit leaves it for loadSettledUpload to retry.
+func (s *Server) finishUpload(ctx context.Context, ac *AgentConn, u *upload) error {
+	err := s.commitUpload(ctx, ac, u)
+	var agentErr *AgentError
+	if !errors.As(err, &agentErr) {
+		return err
+	}
+	if aerr := s.uploadRequest(ctx, ac, pkg.TypeUploadAbort, u, nil); aerr != nil {
+		log.Printf("upload %s: discard after failed commit: %v", u.ID, aerr)
+		return err
+	}
+	s.saveUploadOffset(ctx, u.ID, u.Offset, 0)
+	u.Offset = 0
+	return err
+}
+
+// statUpload returns the number of bytes the agent holds for u. The agent is authoritative:
+// a transfer cut off mid-PATCH may have landed more bytes than were recorded.
+func (s *Server) statUpload(ctx context.Context, ac *AgentConn, u *upload) (int64, error) {
+	var resp pkg.UploadResponse
+	if err := s.uploadRequest(ctx, ac, pkg.TypeUploadStat, u, &resp); err != nil {
+		return 0, err
+	}
+	return resp.Size, nil
+}
+
+// commitUpload moves the partial file into place and marks the upload complete. If the upload
+// metadata carries "sha256" (hex), the agent verifies the file first.
+func (s *Server) commitUpload(ctx context.Context, ac *AgentConn, u *upload) error {
+	if err := s.uploadRequest(ctx, ac, pkg.TypeUploadCommit, u, nil); err != nil {
+		return err
+	}
+	_, err := s.pool.Exec(ctx, `UPDATE uploads SET completed_at = now() WHERE id::text = $1`, u.ID)
+	return err
+}
+
+// uploadRequest sends an upload_stat/commit/abort for u and decodes the reply into out (if non-nil).
+func (s *Server) uploadRequest(ctx context.Context, ac *AgentConn, typ string, u *upload, out *pkg.UploadResponse) error {
+	reqID := uuid.New().String()
+	req := pkg.UploadRequest{Type: typ, RequestID: reqID, Path: u.Path, UploadID: u.ID}
+	if typ == pkg.TypeUploadCommit {
+		req.SHA256 = parseUploadMetadata(u.Metadata)["sha256"]
+	}
+	respData, err := ac.Request(ctx, reqID, req)
+	if err != nil {
+		return err
+	}
+	var resp pkg.UploadResponse
+	if err := json.Unmarshal(respData, &resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return &AgentError{Msg: resp.Error}
+	}
+	if out != nil {
+		*out = resp
+	}
+	return nil
+}
+
+// expireUploads deletes expired upload sessions and asks connected agents to drop their partial files.
+func (s *Server) expireUploads(ctx context.Context) {
+	rows, err := s.pool.Query(ctx,
+		`DELETE FROM uploads WHERE expires_at < now() RETURNING id::text, agent_id::text, path, completed_at IS NOT NULL`)
+	if err != nil {
+		log.Printf("expire uploads: %v", err)
+		return
+	}
+	var stale []upload
+	for rows.Next() {
+		var u upload
+		var completed bool
+		if err := rows.Scan(&u.ID, &u.AgentID, &u.Path, &completed); err != nil {
+			log.Printf("expire uploads: %v", err)
+			break
+		}
+		if !completed {
+			stale = append(stale, u)
+		}
+	}
+	rows.Close()
+	for i := range stale {
+		if ac := s.hub.Get(stale[i].AgentID); ac != nil {
+			rctx, cancel := context.WithTimeout(ctx, proxyTimeout)
+			if err := s.uploadRequest(rctx, ac, pkg.TypeUploadAbort, &stale[i], nil); err != nil {
+				log.Printf("expire upload %s: %v", stale[i].ID, err)
+			}
+			cancel()
+		}
+	}
+}
+
+// runUploadJanitor expires uploads every hour until ctx is done.
+func (s *Server) runUploadJanitor(ctx context.Context) {
+	t := time.NewTicker(time.Hour)
+	defer t.Stop()
+	for {
+		s.expireUploads(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// countingReader counts bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
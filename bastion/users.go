@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// userInfo is a row of the users table as listed to admins.
+type userInfo struct {
+	ID          string    `json:"id"`
+	Username    string    `json:"username"`
+	Admin       bool      `json:"admin"`
+	TOTPEnabled bool      `json:"totp_enabled"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+var errUserUnchanged = errors.New("user not changed")
+
+// ListUsers lists all users. Admins only. GET /api/users
+func (s *Server) ListUsers(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.pool.Query(r.Context(),
+		`SELECT id::text, username, is_admin, totp_secret IS NOT NULL, created_at FROM users ORDER BY username`)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	defer rows.Close()
+	list := []userInfo{}
+	for rows.Next() {
+		var u userInfo
+		if err := rows.Scan(&u.ID, &u.Username, &u.Admin, &u.TOTPEnabled, &u.CreatedAt); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		list = append(list, u)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(list)
+}
+
+// CreateUserAccount adds a user. New users see no agents until granted access to them.
+// Admins only. POST /api/users {"username","password","admin"}
+func (s *Server) CreateUserAccount(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Admin    bool   `json:"admin"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad request")
+		return
+	}
+	if req.Username == "" || req.Password == "" {
+		writeJSONError(w, http.StatusBadRequest, "username and password required")
+		return
+	}
+	user, err := CreateUser(r.Context(), s.pool, req.Username, req.Password, req.Admin)
+	if err != nil {
+		if isDuplicate(err) {
+			writeJSONError(w, http.StatusConflict, "username already exists")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(userInfo{ID: user.ID, Username: user.Username, Admin: user.Admin, CreatedAt: time.Now()})
+}
+
+// UpdateUser sets a user's password or admin flag. A new password ends the user's sessions.
+// The last admin cannot be demoted. Admins only. PATCH /api/users/:id {"password","admin"}
+func (s *Server) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var req struct {
+		Password *string `json:"password"`
+		Admin    *bool   `json:"admin"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad request")
+		return
+	}
+	if req.Password != nil && *req.Password == "" {
+		writeJSONError(w, http.StatusBadRequest, "password must not be empty")
+		return
+	}
+	if req.Password == nil && req.Admin == nil {
+		writeJSONError(w, http.StatusBadRequest, "password or admin required")
+		return
+	}
+	var hash string
+	if req.Password != nil {
+		var err error
+		if hash, err = HashPassword(*req.Password); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+	}
+	err := pgx.BeginFunc(r.Context(), s.pool, func(tx pgx.Tx) error {
+		if req.Admin != nil {
+			// The condition keeps at least one admin.
+			result, err := tx.Exec(r.Context(),
+				`UPDATE users SET is_admin = $2 WHERE id::text = $1 AND ($2 OR EXISTS (SELECT 1 FROM users WHERE is_admin AND id::text <> $1))`,
+				id, *req.Admin)
+			if err != nil {
+				return err
+			}
+			if result.RowsAffected() == 0 {
+				return errUserUnchanged
+			}
+		}
+		if req.Password != nil {
+			result, err := tx.Exec(r.Context(), `UPDATE users SET password_hash = $2 WHERE id::text = $1`, id, hash)
+			if err != nil {
+				return err
+			}
+			if result.RowsAffected() == 0 {
+				return errUserUnchanged
+			}
+			if _, err := tx.Exec(r.Context(), `DELETE FROM sessions WHERE user_id::text = $1`, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errUserUnchanged) {
+		s.userConflict(w, r, id, "cannot demote the last admin")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteUser removes a user with their sessions and grants. The last admin cannot be
+// deleted. Admins only. DELETE /api/users/:id
+func (s *Server) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	result, err := s.pool.Exec(r.Context(),
+		`DELETE FROM users WHERE id::text = $1 AND (NOT is_admin OR EXISTS (SELECT 1 FROM users WHERE is_admin AND id::text <> $1))`, id)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if result.RowsAffected() == 0 {
+		s.userConflict(w, r, id, "cannot delete the last admin")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// userConflict answers a change to user id that did not apply: 404 if the user does not
+// exist, else 409 with message.
+func (s *Server) userConflict(w http.ResponseWriter, r *http.Request, id, message string) {
+	_, err := GetUserByID(r.Context(), s.pool, id)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		writeJSONError(w, http.StatusNotFound, "not found")
+	case err != nil:
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+	default:
+		writeJSONError(w, http.StatusConflict, message)
+	}
+}
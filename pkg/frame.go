@@ -0,0 +1,76 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Binary frames carry raw file bytes over WebSocket binary messages so payloads
+// skip JSON and base64. Control messages stay JSON text messages.
+//
+// Layout (big endian):
+//
+//	version   uint8   FrameVersion
+//	type      uint8   FrameStreamChunk, ...
+//	id length uint8
+//	id        request_id bytes
+//	seq       uint64
+//	payload   remaining bytes
+const (
+	FrameVersion = 1
+
+	FrameStreamChunk = 1 // one stream chunk; seq as in stream_ack/stream_close
+)
+
+const frameFixedLen = 1 + 1 + 1 + 8
+
+// Frame is a decoded binary frame. Payload aliases the buffer passed to DecodeFrame.
+type Frame struct {
+	Type      byte
+	RequestID string
+	Seq       int64
+	Payload   []byte
+}
+
+// FrameHeaderLen returns the header size of a frame for requestID.
+func FrameHeaderLen(requestID string) int {
+	return frameFixedLen + len(requestID)
+}
+
+// AppendFrameHeader appends a frame header to dst. The payload is whatever the caller appends after it,
+// which lets senders read file data directly into the frame buffer.
+func AppendFrameHeader(dst []byte, typ byte, requestID string, seq int64) ([]byte, error) {
+	if len(requestID) > 255 {
+		return dst, fmt.Errorf("frame: request_id too long")
+	}
+	dst = append(dst, FrameVersion, typ, byte(len(requestID)))
+	dst = append(dst, requestID...)
+	return binary.BigEndian.AppendUint64(dst, uint64(seq)), nil
+}
+
+// EncodeFrame returns f as a binary frame.
+func EncodeFrame(f Frame) ([]byte, error) {
+	buf := make([]byte, 0, FrameHeaderLen(f.RequestID)+len(f.Payload))
+	buf, err := AppendFrameHeader(buf, f.Type, f.RequestID, f.Seq)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, f.Payload...), nil
+}
+
+// DecodeFrame parses a binary frame without copying the payload.
+func DecodeFrame(b []byte) (Frame, error) {
+	if len(b) < frameFixedLen {
+		return Frame{}, fmt.Errorf("frame: short header")
+	}
+	if b[0] != FrameVersion {
+		return Frame{}, fmt.Errorf("frame: unsupported version %d", b[0])
+	}
+	idLen := int(b[2])
+	if len(b) < frameFixedLen+idLen {
+		return Frame{}, fmt.Errorf("frame: short header")
+	}
+	id := string(b[3 : 3+idLen])
+	seq := binary.BigEndian.Uint64(b[3+idLen : frameFixedLen+idLen])
+	return Frame{Type: b[1], RequestID: id, Seq: int64(seq), Payload: b[frameFixedLen+idLen:]}, nil
+}
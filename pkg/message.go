@@ -1,28 +1,80 @@
 package pkg
 
+import "time"
+
+// ProtocolVersion is the agent-bastion protocol revision sent in the auth handshake.
+// Agents that predate the handshake fields report 0.
+const ProtocolVersion = 1
+
+// Keepalive: each side sends a WebSocket ping every PingInterval and drops the connection
+// when nothing (message, ping or pong) has arrived for PongWait. Pings are answered by the
+// WebSocket library, so peers that predate the keepalive still keep the connection up.
+const (
+	PingInterval = 20 * time.Second
+	PongWait     = 60 * time.Second
+	PingTimeout  = 10 * time.Second // deadline for writing a ping or pong
+)
+
+// Capabilities an agent advertises in Auth. Message types added after protocol 0
+// are only sent to agents that advertise the matching capability.
+const (
+	CapStream    = "stream"    // stream_open/ack/close with binary chunk frames
+	CapErrors    = "errors"    // replies with an "error" message to unknown request types
+	CapCancel    = "cancel"    // aborts in-flight work on "cancel"
+	CapUpload    = "upload"    // resumable uploads: stream_open upload_id/offset, upload_stat/commit/abort
+	CapSHA256    = "sha256"    // verifies StreamClose.SHA256 / UploadRequest.SHA256 before committing a write
+	CapFileOps   = "fileops"   // rename, copy, mkdir
+	CapExtract   = "extract"   // extract zip/tar/tar.gz archives
+	CapHash      = "hash"      // hash, with hash_entries for directory trees
+	CapSearch    = "search"    // search, with search_matches
+	CapWatch     = "watch"     // pushes fs_event messages for changes below the hosted root
+	CapNoReplace = "noreplace" // honours StreamOpen.NoReplace
+)
+
 // Message types for agent-bastion WebSocket protocol.
 const (
-	TypeAuth      = "auth"
-	TypeAuthOK    = "auth_ok"
-	TypeAuthError = "auth_error"
-	TypeListDir   = "list_dir"
-	TypeReadFile  = "read_file"
-	TypeWriteFile = "write_file"
-	TypeGetMeta    = "get_meta"
-	TypeDeleteFile = "delete_file"
-	TypeGetDisk    = "get_disk"
+	TypeAuth          = "auth"
+	TypeAuthOK        = "auth_ok"
+	TypeAuthError     = "auth_error"
+	TypeListDir       = "list_dir"
+	TypeReadFile      = "read_file"
+	TypeWriteFile     = "write_file"
+	TypeGetMeta       = "get_meta"
+	TypeDeleteFile    = "delete_file"
+	TypeGetDisk       = "get_disk"
+	TypeRename        = "rename"
+	TypeCopy          = "copy"
+	TypeMkdir         = "mkdir"
+	TypeExtract       = "extract"
+	TypeHash          = "hash"
+	TypeHashEntries   = "hash_entries"
+	TypeSearch        = "search"
+	TypeSearchMatches = "search_matches"
+	TypeFsEvent       = "fs_event"
+	TypeError         = "error"
+	TypeCancel        = "cancel"
+)
+
+// Error codes carried in ErrorResponse.
+const (
+	ErrCodeUnsupported = "unsupported"
+	ErrCodeBusy        = "busy" // the agent's request queue is full; retry later
 )
 
 // Auth is sent by agent to bastion after WebSocket connect.
 type Auth struct {
-	Type  string `json:"type"` // "auth"
-	Token string `json:"token"`
+	Type            string   `json:"type"` // "auth"
+	Token           string   `json:"token"`
+	ProtocolVersion int      `json:"protocol_version,omitempty"`
+	AgentVersion    string   `json:"agent_version,omitempty"` // build version of blackbox-agent
+	Capabilities    []string `json:"capabilities,omitempty"`
 }
 
 // AuthOK is sent by bastion to agent after successful auth.
 type AuthOK struct {
-	Type    string `json:"type"` // "auth_ok"
-	AgentID string `json:"agent_id"`
+	Type            string `json:"type"` // "auth_ok"
+	AgentID         string `json:"agent_id"`
+	ProtocolVersion int    `json:"protocol_version,omitempty"`
 }
 
 // AuthError is sent by bastion when agent auth fails.
@@ -31,6 +83,21 @@ type AuthError struct {
 	Error string `json:"error"`
 }
 
+// ErrorResponse is sent by agent when it cannot handle a request at all (e.g. unknown type).
+type ErrorResponse struct {
+	Type      string `json:"type"` // "error"
+	RequestID string `json:"request_id"`
+	Code      string `json:"code,omitempty"` // e.g. "unsupported"
+	Error     string `json:"error"`
+}
+
+// Cancel is sent by bastion when it stops waiting for a request (client gone, timeout).
+// The agent aborts any work for RequestID, including streams, and sends no response.
+type Cancel struct {
+	Type      string `json:"type"` // "cancel"
+	RequestID string `json:"request_id"`
+}
+
 // ListDirRequest is sent by bastion to agent (path relative to hosted root).
 type ListDirRequest struct {
 	Type      string `json:"type"` // "list_dir"
@@ -50,8 +117,8 @@ type FileEntry struct {
 type ListDirResponse struct {
 	Type      string      `json:"type"` // "list_dir"
 	RequestID string      `json:"request_id"`
-	Entries  []FileEntry  `json:"entries,omitempty"`
-	Error    string       `json:"error,omitempty"`
+	Entries   []FileEntry `json:"entries,omitempty"`
+	Error     string      `json:"error,omitempty"`
 }
 
 // ReadFileRequest is sent by bastion to agent.
@@ -67,8 +134,8 @@ type ReadFileRequest struct {
 type ReadFileResponse struct {
 	Type      string `json:"type"` // "read_file"
 	RequestID string `json:"request_id"`
-	Data     string `json:"data,omitempty"` // base64
-	Error    string `json:"error,omitempty"`
+	Data      string `json:"data,omitempty"` // base64
+	Error     string `json:"error,omitempty"`
 }
 
 // WriteFileRequest is sent by bastion to agent. Data is base64-encoded.
@@ -76,14 +143,14 @@ type WriteFileRequest struct {
 	Type      string `json:"type"` // "write_file"
 	RequestID string `json:"request_id"`
 	Path      string `json:"path"`
-	Data     string `json:"data"` // base64
+	Data      string `json:"data"` // base64
 }
 
 // WriteFileResponse is sent by agent to bastion.
 type WriteFileResponse struct {
 	Type      string `json:"type"` // "write_file"
 	RequestID string `json:"request_id"`
-	Error    string `json:"error,omitempty"`
+	Error     string `json:"error,omitempty"`
 }
 
 // GetMetaRequest is sent by bastion to agent.
@@ -97,10 +164,10 @@ type GetMetaRequest struct {
 type GetMetaResponse struct {
 	Type      string `json:"type"` // "get_meta"
 	RequestID string `json:"request_id"`
-	Size     int64  `json:"size,omitempty"`
-	Mtime    string `json:"mtime,omitempty"` // RFC3339
-	IsDir    bool   `json:"is_dir,omitempty"`
-	Error    string `json:"error,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	Mtime     string `json:"mtime,omitempty"` // RFC3339
+	IsDir     bool   `json:"is_dir,omitempty"`
+	Error     string `json:"error,omitempty"`
 }
 
 // DeleteFileRequest is sent by bastion to agent.
@@ -114,7 +181,197 @@ type DeleteFileRequest struct {
 type DeleteFileResponse struct {
 	Type      string `json:"type"` // "delete_file"
 	RequestID string `json:"request_id"`
-	Error    string `json:"error,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// RenameRequest is sent by bastion to agent to move From to To (both relative to hosted root).
+// Missing parent directories of To are created. An existing To is an error unless Overwrite is set.
+type RenameRequest struct {
+	Type      string `json:"type"` // "rename"
+	RequestID string `json:"request_id"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Overwrite bool   `json:"overwrite,omitempty"`
+}
+
+// RenameResponse is sent by agent to bastion.
+type RenameResponse struct {
+	Type      string `json:"type"` // "rename"
+	RequestID string `json:"request_id"`
+	Error     string `json:"error,omitempty"`
+}
+
+// CopyRequest is sent by bastion to agent to copy a file or directory tree From to To.
+// Missing parent directories of To are created. An existing To is an error unless Overwrite is set.
+type CopyRequest struct {
+	Type      string `json:"type"` // "copy"
+	RequestID string `json:"request_id"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Overwrite bool   `json:"overwrite,omitempty"`
+}
+
+// CopyResponse is sent by agent to bastion.
+type CopyResponse struct {
+	Type      string `json:"type"` // "copy"
+	RequestID string `json:"request_id"`
+	Error     string `json:"error,omitempty"`
+}
+
+// MkdirRequest is sent by bastion to agent to create a directory (and missing parents).
+type MkdirRequest struct {
+	Type      string `json:"type"` // "mkdir"
+	RequestID string `json:"request_id"`
+	Path      string `json:"path"`
+}
+
+// MkdirResponse is sent by agent to bastion.
+type MkdirResponse struct {
+	Type      string `json:"type"` // "mkdir"
+	RequestID string `json:"request_id"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ExtractRequest is sent by bastion to agent to unpack the zip, tar or tar.gz archive at Path
+// into the directory Dest. Entries that would land outside Dest are refused.
+type ExtractRequest struct {
+	Type      string `json:"type"` // "extract"
+	RequestID string `json:"request_id"`
+	Path      string `json:"path"`
+	Dest      string `json:"dest"`
+	Overwrite bool   `json:"overwrite,omitempty"` // replace existing files instead of reporting them
+}
+
+// ExtractFailure is an archive entry that was not extracted.
+type ExtractFailure struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// ExtractResponse is sent by agent to bastion. Error is set if the archive could not be read
+// at all; entries that failed individually are listed in Failed.
+type ExtractResponse struct {
+	Type      string           `json:"type"` // "extract"
+	RequestID string           `json:"request_id"`
+	Files     int              `json:"files"` // files written
+	Bytes     int64            `json:"bytes"`
+	Failed    []ExtractFailure `json:"failed,omitempty"`
+	Error     string           `json:"error,omitempty"`
+}
+
+// Hash algorithms for HashRequest.Algorithm.
+const (
+	HashSHA256 = "sha256"
+	HashBLAKE3 = "blake3" // 256-bit output
+	HashXXHash = "xxhash" // XXH64; fast, not cryptographic
+)
+
+// HashRequest is sent by bastion to agent to hash the file or directory tree at Path.
+// For a directory the agent sends the digest of every regular file below it in
+// HashEntries messages (same request_id, depth-first with names sorted) before the HashResponse.
+type HashRequest struct {
+	Type      string `json:"type"` // "hash"
+	RequestID string `json:"request_id"`
+	Path      string `json:"path"`
+	Algorithm string `json:"algorithm,omitempty"` // default HashSHA256
+}
+
+// HashEntry is the digest of one file, or the reason it could not be read.
+// Path is slash-separated and relative to the requested directory.
+type HashEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Digest string `json:"digest,omitempty"` // lowercase hex
+	Error  string `json:"error,omitempty"`
+}
+
+// HashEntries is sent by agent to bastion while a directory is being hashed.
+type HashEntries struct {
+	Type      string      `json:"type"` // "hash_entries"
+	RequestID string      `json:"request_id"`
+	Entries   []HashEntry `json:"entries"`
+}
+
+// HashResponse is sent by agent to bastion. For a file, Digest is the file's digest. For a
+// directory, Digest hashes the manifest of "<digest>  <path>\n" lines for all entries sorted
+// by path (the sha256sum format), so two trees with the same content have the same digest; it is
+// empty if any file failed.
+type HashResponse struct {
+	Type      string `json:"type"` // "hash"
+	RequestID string `json:"request_id"`
+	Algorithm string `json:"algorithm"`
+	Digest    string `json:"digest,omitempty"`
+	Files     int    `json:"files"`
+	Bytes     int64  `json:"bytes"`
+	Failed    int    `json:"failed,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// SearchRequest is sent by bastion to agent to find entries below the directory Path. Name is
+// matched against each entry's base name, as a case-insensitive glob or, with Regex, a regular
+// expression. Content, if set, restricts matches to text files containing it (case-insensitive
+// substring, or a regular expression with Regex). At least one of Name and Content is required.
+// Matches are sent in SearchMatches messages (same request_id) before the SearchResponse.
+type SearchRequest struct {
+	Type      string `json:"type"` // "search"
+	RequestID string `json:"request_id"`
+	Path      string `json:"path"`
+	Name      string `json:"name,omitempty"`
+	Content   string `json:"content,omitempty"`
+	Regex     bool   `json:"regex,omitempty"`
+	Limit     int    `json:"limit,omitempty"` // maximum matches; the agent caps it
+}
+
+// SearchMatch is one matching entry. Path is slash-separated and relative to the hosted root.
+// For content searches, Line and Text are the first matching line (1-based) and its text.
+type SearchMatch struct {
+	Path  string `json:"path"`
+	IsDir bool   `json:"is_dir"`
+	Size  int64  `json:"size"`
+	Mtime string `json:"mtime"`
+	Line  int    `json:"line,omitempty"`
+	Text  string `json:"text,omitempty"`
+}
+
+// SearchMatches is sent by agent to bastion as matches are found.
+type SearchMatches struct {
+	Type      string        `json:"type"` // "search_matches"
+	RequestID string        `json:"request_id"`
+	Matches   []SearchMatch `json:"matches"`
+}
+
+// SearchResponse is sent by agent to bastion when the search ends. Truncated is set if it
+// stopped at the limit.
+type SearchResponse struct {
+	Type      string `json:"type"` // "search"
+	RequestID string `json:"request_id"`
+	Matches   int    `json:"matches"`
+	Truncated bool   `json:"truncated,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Operations in FsEvent. A rename reports the old path; the new name arrives as a create.
+// FsOverflow means events were lost (Path is empty): anything below the root may have changed.
+const (
+	FsCreate   = "create"
+	FsModify   = "modify"
+	FsDelete   = "delete"
+	FsRename   = "rename"
+	FsOverflow = "overflow"
+)
+
+// FsEvent is one change below the hosted root. Path is slash-separated and relative to it.
+type FsEvent struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	IsDir bool   `json:"is_dir,omitempty"` // known for creates only
+}
+
+// FsEvents is pushed by agent to bastion, unsolicited, as changes happen. Events are
+// coalesced over a short window, so a file written many times is reported once.
+type FsEvents struct {
+	Type   string    `json:"type"` // "fs_event"
+	Events []FsEvent `json:"events"`
 }
 
 // GetDiskRequest is sent by bastion to agent (disk stats for hosted root volume).
@@ -131,3 +388,90 @@ type GetDiskResponse struct {
 	TotalBytes int64  `json:"total_bytes,omitempty"`
 	Error      string `json:"error,omitempty"`
 }
+
+// Chunked streams carry file contents in bounded pieces instead of a single
+// message. Bastion opens a stream with StreamOpen; the sender of data emits
+// chunks numbered from 1 as binary frames (FrameStreamChunk, see frame.go) and
+// the receiver acknowledges each one with StreamAck. At most StreamWindow
+// chunks may be unacknowledged at a time. StreamClose ends the stream: Seq is
+// the last chunk sent, Error aborts it.
+//
+// Read: bastion -> stream_open(read); agent -> chunks..., stream_close.
+// Write: bastion -> stream_open(write); agent -> stream_ack(seq 0) once the
+// file is open; bastion -> chunks..., stream_close; agent -> stream_close.
+const (
+	TypeStreamOpen  = "stream_open"
+	TypeStreamChunk = "stream_chunk" // sent as FrameStreamChunk, never as JSON
+	TypeStreamAck   = "stream_ack"
+	TypeStreamClose = "stream_close"
+
+	StreamOpRead  = "read"
+	StreamOpWrite = "write"
+
+	StreamChunkSize = 256 << 10 // bytes per chunk
+	StreamWindow    = 16        // max unacknowledged chunks in flight
+)
+
+// StreamOpen is sent by bastion to agent to start a chunked read or write.
+type StreamOpen struct {
+	Type      string `json:"type"` // "stream_open"
+	RequestID string `json:"request_id"`
+	Op        string `json:"op"` // "read" | "write"
+	Path      string `json:"path"`
+	Offset    int64  `json:"offset,omitempty"` // read: start; write with UploadID: resume position
+	Size      int64  `json:"size,omitempty"`   // read only; 0 = to end of file
+	// UploadID makes a write append to the partial file of a resumable upload at Offset
+	// instead of replacing Path. The partial file is kept if the stream is aborted.
+	UploadID string `json:"upload_id,omitempty"`
+	// NoReplace makes a write fail with StreamErrExists, checked atomically when the file is
+	// moved into place, if Path already exists.
+	NoReplace bool `json:"no_replace,omitempty"`
+}
+
+// StreamErrExists is the StreamClose error of a NoReplace write whose path exists.
+const StreamErrExists = "already exists"
+
+// StreamAck acknowledges all chunks up to and including Seq.
+type StreamAck struct {
+	Type      string `json:"type"` // "stream_ack"
+	RequestID string `json:"request_id"`
+	Seq       int64  `json:"seq"`
+}
+
+// StreamClose ends a stream. Seq is the last chunk sent; a non-empty Error aborts the stream.
+// Writes are committed atomically (temp file, fsync, rename) when the agent receives the
+// close; if SHA256 (hex) is set the agent verifies the written content first.
+type StreamClose struct {
+	Type      string `json:"type"` // "stream_close"
+	RequestID string `json:"request_id"`
+	Seq       int64  `json:"seq"`
+	Error     string `json:"error,omitempty"`
+	SHA256    string `json:"sha256,omitempty"` // write only
+}
+
+// Resumable uploads keep a partial file next to the destination while chunks arrive
+// over write streams (StreamOpen.UploadID). upload_stat reports how many bytes the
+// partial file holds, upload_commit moves it over the destination and upload_abort
+// removes it. All three use UploadRequest and UploadResponse.
+const (
+	TypeUploadStat   = "upload_stat"
+	TypeUploadCommit = "upload_commit"
+	TypeUploadAbort  = "upload_abort"
+)
+
+// UploadRequest is sent by bastion to agent for upload_stat, upload_commit and upload_abort.
+type UploadRequest struct {
+	Type      string `json:"type"`
+	RequestID string `json:"request_id"`
+	Path      string `json:"path"` // destination, relative to hosted root
+	UploadID  string `json:"upload_id"`
+	SHA256    string `json:"sha256,omitempty"` // upload_commit: verify the complete file (hex)
+}
+
+// UploadResponse is sent by agent to bastion. Size is the partial file size (upload_stat).
+type UploadResponse struct {
+	Type      string `json:"type"`
+	RequestID string `json:"request_id"`
+	Size      int64  `json:"size"`
+	Error     string `json:"error,omitempty"`
+}